@@ -0,0 +1,507 @@
+// Command svm assembles, disassembles, runs and debugs programs of the stack
+// based virtual machine.
+//
+//	svm asm file.sasm [-o out.img]
+//	svm disasm file.img
+//	svm verify file.img
+//	svm cfg file.img [-o graph.dot]
+//	svm run file.img [machine flags] [--trace trace.jsonl] [--profile cpu.pprof]
+//	svm trace file.img [machine flags] [-o trace.jsonl]
+//	svm debug file.img [machine flags]
+//
+// The machine flags of run, trace and debug are
+//
+//	[--mem 80M] [--heap 1M] [--heap-debug] [--deterministic] [--verify] [--gas N]
+//
+// verify, cfg, run, trace and debug also accept a .sasm file, which is assembled first.
+// trace sends the output of the program to standard error when the trace goes
+// to standard output.
+// The exit status is 0 when the program halts, 1 on errors, 2 on bad usage
+// and 10 plus the fault kind when the program faults.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nguyenzung/StackBasedVirtualMachine/vm"
+	"github.com/nguyenzung/StackBasedVirtualMachine/vm/analysis"
+	"github.com/nguyenzung/StackBasedVirtualMachine/vm/asm"
+	"github.com/nguyenzung/StackBasedVirtualMachine/vm/debug"
+)
+
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+	exitFault = 10 // Plus the vm.FaultKind
+)
+
+const usage = `usage:
+  svm asm file.sasm [-o out.img]
+  svm disasm file.img
+  svm verify file.img
+  svm cfg file.img [-o graph.dot]
+  svm run file.img [machine flags] [--trace trace.jsonl] [--profile cpu.pprof]
+  svm trace file.img [machine flags] [-o trace.jsonl]
+  svm debug file.img [machine flags]
+machine flags:
+  [--mem 80M] [--heap 1M] [--heap-debug] [--deterministic] [--verify] [--gas N]
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// errUsage is returned for bad command lines, the usage has been printed
+var errUsage = errors.New("bad usage")
+
+type command struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	cmd := &command{stdin: stdin, stdout: stdout, stderr: stderr}
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+	var err error
+	switch args[0] {
+	case "asm":
+		err = cmd.asm(args[1:])
+	case "disasm":
+		err = cmd.disasm(args[1:])
+	case "verify":
+		err = cmd.verify(args[1:])
+	case "cfg":
+		err = cmd.cfg(args[1:])
+	case "run":
+		err = cmd.run(args[1:])
+	case "trace":
+		err = cmd.trace(args[1:])
+	case "debug":
+		err = cmd.debug(args[1:])
+	case "help", "-h", "--help":
+		fmt.Fprint(stdout, usage)
+		return exitOK
+	default:
+		fmt.Fprintf(stderr, "unknown command %s\n%s", args[0], usage)
+		return exitUsage
+	}
+	var fault *vm.Fault
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, errUsage):
+		return exitUsage
+	case errors.As(err, &fault):
+		fmt.Fprintf(stderr, "fault: %v\n", err)
+		return exitFault + int(fault.Kind)
+	}
+	fmt.Fprintf(stderr, "svm: %v\n", err)
+	return exitError
+}
+
+// parse parses flags placed before or after the file argument and returns
+// the file
+func (cmd *command) parse(flags *flag.FlagSet, args []string) (string, error) {
+	flags.SetOutput(cmd.stderr)
+	var files []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return "", errUsage
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		files = append(files, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+	if len(files) != 1 {
+		fmt.Fprintf(cmd.stderr, "%s expects one file\n%s", flags.Name(), usage)
+		return "", errUsage
+	}
+	return files[0], nil
+}
+
+func (cmd *command) asm(args []string) error {
+	flags := flag.NewFlagSet("asm", flag.ContinueOnError)
+	out := flags.String("o", "", "output image, the source file name with .img by default")
+	file, err := cmd.parse(flags, args)
+	if err != nil {
+		return err
+	}
+	program, err := assemble(file)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		*out = strings.TrimSuffix(file, filepath.Ext(file)) + ".img"
+	}
+	return writeImage(*out, program.Image())
+}
+
+func (cmd *command) disasm(args []string) error {
+	flags := flag.NewFlagSet("disasm", flag.ContinueOnError)
+	file, err := cmd.parse(flags, args)
+	if err != nil {
+		return err
+	}
+	image, err := load(file)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(cmd.stdout)
+	var names []string
+	for name, value := range image.Symbols {
+		if value == image.Entry {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	entry := strconv.FormatUint(image.Entry, 10)
+	if len(names) > 0 {
+		entry = names[0]
+	}
+	fmt.Fprintf(w, ".entry %s\n", entry)
+	if err := asm.Fprint(w, image.Code, image.Symbols); err != nil {
+		return err
+	}
+	if len(image.Data) > 0 {
+		fmt.Fprintf(w, ".data\n")
+	}
+	for i := 0; i < len(image.Data); i += 16 {
+		line := image.Data[i:]
+		if len(line) > 16 {
+			line = line[:16]
+		}
+		values := make([]string, len(line))
+		for j, b := range line {
+			values[j] = fmt.Sprintf("0x%02x", b)
+		}
+		fmt.Fprintf(w, "\t.byte %s\n", strings.Join(values, ", "))
+	}
+	return w.Flush()
+}
+
+// verify prints the diagnostics of vm.Verify, it fails when there are any
+func (cmd *command) verify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	file, err := cmd.parse(flags, args)
+	if err != nil {
+		return err
+	}
+	image, err := load(file)
+	if err != nil {
+		return err
+	}
+	diagnostics := vm.Verify(image.Code, image.Entry)
+	for _, diagnostic := range diagnostics {
+		fmt.Fprintf(cmd.stdout, "%s:%s\n", file, diagnostic)
+	}
+	if len(diagnostics) > 0 {
+		return &vm.VerifyError{Diagnostics: diagnostics}
+	}
+	return nil
+}
+
+// cfg writes the control flow graph of the program in Graphviz DOT
+func (cmd *command) cfg(args []string) error {
+	flags := flag.NewFlagSet("cfg", flag.ContinueOnError)
+	out := flags.String("o", "", "output file, standard output by default")
+	file, err := cmd.parse(flags, args)
+	if err != nil {
+		return err
+	}
+	image, err := load(file)
+	if err != nil {
+		return err
+	}
+	graph := analysis.Build(image.Code, image.Entry)
+	if *out == "" {
+		return graph.WriteDot(cmd.stdout, image.Symbols)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := graph.WriteDot(f, image.Symbols); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (cmd *command) run(args []string) error {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	machineFlags := addMachineFlags(flags)
+	trace := flags.String("trace", "", "write a JSON lines trace to this file")
+	profile := flags.String("profile", "", "write a pprof profile to this file")
+	file, err := cmd.parse(flags, args)
+	if err != nil {
+		return err
+	}
+	machine, image, err := machineFlags.boot(file)
+	if err != nil {
+		return err
+	}
+	machine.SetStdio(cmd.stdin, cmd.stdout)
+	var tracer *vm.Tracer
+	var traceOut *bufio.Writer
+	if *trace != "" {
+		f, err := os.Create(*trace)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		traceOut = bufio.NewWriter(f)
+		tracer = vm.NewTracer(traceOut)
+		machine.SetTracer(tracer)
+	}
+	var profiler *vm.Profiler
+	if *profile != "" {
+		profiler = vm.NewProfiler()
+		machine.SetProfiler(profiler)
+	}
+
+	runErr := machine.StartVM()
+	var verifyErr *vm.VerifyError
+	if errors.As(runErr, &verifyErr) {
+		return runErr
+	}
+	cmd.printResult(machine, runErr)
+	if tracer != nil {
+		if err := tracer.Err(); err != nil {
+			return err
+		}
+		if err := traceOut.Flush(); err != nil {
+			return err
+		}
+	}
+	if profiler != nil {
+		if err := writeProfile(*profile, profiler, image.Symbols); err != nil {
+			return err
+		}
+	}
+	return runErr
+}
+
+func (cmd *command) trace(args []string) error {
+	flags := flag.NewFlagSet("trace", flag.ContinueOnError)
+	machineFlags := addMachineFlags(flags)
+	out := flags.String("o", "", "output file, standard output by default")
+	file, err := cmd.parse(flags, args)
+	if err != nil {
+		return err
+	}
+	machine, _, err := machineFlags.boot(file)
+	if err != nil {
+		return err
+	}
+	// The guest writes to standard error while the trace takes standard output
+	w := bufio.NewWriter(cmd.stdout)
+	machine.SetStdio(cmd.stdin, cmd.stderr)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = bufio.NewWriter(f)
+		machine.SetStdio(cmd.stdin, cmd.stdout)
+	}
+	tracer := vm.NewTracer(w)
+	machine.SetTracer(tracer)
+	runErr := machine.StartVM()
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if tracer.Err() != nil {
+		return tracer.Err()
+	}
+	return runErr
+}
+
+func (cmd *command) debug(args []string) error {
+	flags := flag.NewFlagSet("debug", flag.ContinueOnError)
+	machineFlags := addMachineFlags(flags)
+	file, err := cmd.parse(flags, args)
+	if err != nil {
+		return err
+	}
+	machine, image, err := machineFlags.boot(file)
+	if err != nil {
+		return err
+	}
+	// Commands and guest input are read in turn from the same stream
+	in := bufio.NewReader(cmd.stdin)
+	machine.SetStdio(in, cmd.stdout)
+	return debug.New(machine, image.Symbols, cmd.stdout).Run(in)
+}
+
+// printResult prints the final stack, top first, and how the program ended
+func (cmd *command) printResult(machine *vm.VM, err error) {
+	state := machine.State()
+	stack := machine.Stack()
+	fmt.Fprintf(cmd.stdout, "stack (%d):\n", len(stack))
+	for i := len(stack) - 1; i >= 0; i-- {
+		fmt.Fprintf(cmd.stdout, "  %-20d 0x%016x\n", stack[i], stack[i])
+	}
+	status := "halted"
+	if err != nil {
+		status = "fault"
+	}
+	fmt.Fprintf(cmd.stdout, "%s at ip %d after %d steps, gas %d\n", status, state.IP, state.Steps, state.GasUsed)
+}
+
+// machineFlags are the flags shared by the subcommands that execute a
+// program, so that an image runs on the same machine under each of them
+type machineFlags struct {
+	mem           *string
+	heap          *string
+	heapDebug     *bool
+	deterministic *bool
+	verify        *bool
+	gas           *uint64
+}
+
+func addMachineFlags(flags *flag.FlagSet) *machineFlags {
+	return &machineFlags{
+		mem:           flags.String("mem", "80M", "memory size, with an optional K, M or G suffix"),
+		heap:          flags.String("heap", "0", "heap size at the end of the data segment"),
+		heapDebug:     flags.Bool("heap-debug", false, "detect double frees and uses after free"),
+		deterministic: flags.Bool("deterministic", false, "use a virtual clock and a fixed random seed"),
+		verify:        flags.Bool("verify", false, "verify the program before running it"),
+		gas:           flags.Uint64("gas", 0, "gas limit, 0 for no limit"),
+	}
+}
+
+func (m *machineFlags) config() (vm.Config, error) {
+	config := vm.DefaultConfig()
+	size, err := parseSize(*m.mem)
+	if err != nil {
+		return config, err
+	}
+	heapSize, err := parseSize(*m.heap)
+	if err != nil {
+		return config, err
+	}
+	if size > 1<<32-1 || heapSize > 1<<32-1 {
+		return config, fmt.Errorf("memory size exceeds 4G")
+	}
+	config.MemorySize, config.HeapSize, config.HeapDebug = uint32(size), uint32(heapSize), *m.heapDebug
+	config.Deterministic, config.Verify = *m.deterministic, *m.verify
+	return config, nil
+}
+
+// boot loads file into a new VM set up by the flags
+func (m *machineFlags) boot(file string) (*vm.VM, *vm.Image, error) {
+	config, err := m.config()
+	if err != nil {
+		return nil, nil, err
+	}
+	image, err := load(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	machine, err := vm.NewVM(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := machine.FlashImage(image); err != nil {
+		return nil, nil, err
+	}
+	if *m.gas != 0 {
+		machine.SetGasLimit(*m.gas)
+	}
+	return machine, image, nil
+}
+
+// load reads an image, or assembles a .sasm source file
+func load(file string) (*vm.Image, error) {
+	if filepath.Ext(file) == ".sasm" {
+		program, err := assemble(file)
+		if err != nil {
+			return nil, err
+		}
+		return program.Image(), nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	image, err := vm.LoadImage(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return image, nil
+}
+
+func assemble(file string) (*asm.Program, error) {
+	src, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	program, err := asm.Assemble(src)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", file, err)
+	}
+	return program, nil
+}
+
+func writeImage(file string, image *vm.Image) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := vm.WriteImage(f, image); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func writeProfile(file string, profiler *vm.Profiler, symbols map[string]uint64) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := profiler.WritePprof(f, symbols); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// parseSize parses a byte count with an optional binary K, M or G suffix
+func parseSize(text string) (uint64, error) {
+	multiplier := uint64(1)
+	switch {
+	case strings.HasSuffix(text, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(text, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(text, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		text = text[:len(text)-1]
+	}
+	value, err := strconv.ParseUint(text, 0, 64)
+	if err != nil || value > (1<<64-1)/multiplier {
+		return 0, fmt.Errorf("invalid size %s", text)
+	}
+	return value * multiplier, nil
+}
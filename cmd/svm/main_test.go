@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nguyenzung/StackBasedVirtualMachine/vm"
+	"github.com/nguyenzung/StackBasedVirtualMachine/vm/asm"
+)
+
+const program = `
+.entry main
+.data
+answer:	.word 40
+.text
+add2:	PUSH 0
+	SLOAD
+	PUSH 2
+	ADD
+	RET
+main:	PUSH answer
+	LOAD
+	PUSH 1
+	CALL add2
+	HLT
+`
+
+func write(t *testing.T, name string, content string) string {
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func svm(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(""), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestAsmDisasmRun(t *testing.T) {
+	src := write(t, "prog.sasm", program)
+	img := filepath.Join(filepath.Dir(src), "out.img")
+	if code, _, stderr := svm("asm", src, "-o", img); code != exitOK {
+		t.Fatalf("asm exited with %d: %s", code, stderr)
+	}
+
+	code, listing, stderr := svm("disasm", img)
+	if code != exitOK {
+		t.Fatalf("disasm exited with %d: %s", code, stderr)
+	}
+	if !strings.HasPrefix(listing, ".entry main\n") || !strings.Contains(listing, ".byte 0x28, 0x00") {
+		t.Errorf("Unexpected listing:\n%s", listing)
+	}
+	original, _ := asm.Assemble([]byte(program))
+	again, err := asm.Assemble([]byte(listing))
+	if err != nil {
+		t.Fatalf("%v\n%s", err, listing)
+	}
+	if again.Entry != original.Entry || !bytes.Equal(again.Data, original.Data) || len(again.Code) != len(original.Code) {
+		t.Errorf("Listing does not assemble to the original program:\n%s", listing)
+	}
+
+	trace := filepath.Join(filepath.Dir(src), "trace.jsonl")
+	code, stdout, stderr := svm("run", img, "--mem", "80M", "--trace", trace)
+	if code != exitOK {
+		t.Fatalf("run exited with %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "stack (1):\n  42 ") || !strings.Contains(stdout, "halted at ip 10 after 10 steps") {
+		t.Errorf("Unexpected output:\n%s", stdout)
+	}
+	if data, err := os.ReadFile(trace); err != nil || bytes.Count(data, []byte("\n")) != 10 {
+		t.Errorf("Unexpected trace %q: %v", data, err)
+	}
+
+	code, stdout, _ = svm("trace", src)
+	if code != exitOK || !strings.HasPrefix(stdout, `{"step":0,"ip":5,"op":"PUSH"`) {
+		t.Errorf("trace exited with %d:\n%s", code, stdout)
+	}
+}
+
+func TestSyscalls(t *testing.T) {
+	hello := write(t, "hello.sasm", ".data\nmsg: .ascii \"hi \"\n.text\nSYSCALL 5\nSYSCALL 1\nPUSH msg\nPUSH 3\nSYSCALL 4\nHLT\n")
+	var stdout bytes.Buffer
+	if code := run([]string{"run", hello}, strings.NewReader("!"), &stdout, &stdout); code != exitOK || !strings.HasPrefix(stdout.String(), "!hi stack (0)") {
+		t.Errorf("run exited with %d:\n%s", code, stdout.String())
+	}
+}
+
+func TestStdio(t *testing.T) {
+	hello := write(t, "hello.sasm", ".data\nmsg: .ascii \"hi\\n\"\n.text\nPUSH msg\nPUSH 3\nSYSCALL 4\nHLT\n")
+	code, stdout, stderr := svm("trace", hello)
+	if code != exitOK || stderr != "hi\n" {
+		t.Fatalf("trace exited with %d: %s", code, stderr)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(stdout, "\n"), "\n") {
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Errorf("Trace line %q is not JSON: %v", line, err)
+		}
+	}
+
+	echo := write(t, "echo.sasm", "SYSCALL 5\nSYSCALL 1\nHLT\n")
+	var out bytes.Buffer
+	if code := run([]string{"debug", echo}, strings.NewReader("c\n!\nq\n"), &out, &out); code != exitOK || !strings.Contains(out.String(), "!halted\n") {
+		t.Errorf("debug exited with %d:\n%s", code, out.String())
+	}
+}
+
+func TestVerify(t *testing.T) {
+	if code, stdout, stderr := svm("verify", write(t, "prog.sasm", program)); code != exitOK || stdout != "" {
+		t.Errorf("verify exited with %d: %s%s", code, stdout, stderr)
+	}
+	underflow := write(t, "underflow.sasm", "PUSH 1\nADD\nHLT\n")
+	code, stdout, _ := svm("verify", underflow)
+	if code != exitError || stdout != underflow+":1: stack underflow, ADD needs 2 and the frame holds 1\n" {
+		t.Errorf("verify exited with %d:\n%s", code, stdout)
+	}
+	if code, stdout, stderr := svm("run", "--verify", underflow); code != exitError || stdout != "" || !strings.Contains(stderr, "rom failed verification at 1") {
+		t.Errorf("run --verify exited with %d: %s%s", code, stdout, stderr)
+	}
+}
+
+func TestCFG(t *testing.T) {
+	code, stdout, stderr := svm("cfg", write(t, "prog.sasm", program))
+	if code != exitOK || !strings.HasPrefix(stdout, "digraph rom {") || !strings.Contains(stdout, "b1 -> b0 [style=\"dashed\", label=\"call\"]") {
+		t.Errorf("cfg exited with %d: %s%s", code, stdout, stderr)
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	fault := write(t, "fault.sasm", "PUSH 1\nPUSH 0\nDIV\nHLT\n")
+	if code, _, stderr := svm("run", fault); code != exitFault+int(vm.DivisionByZero) || !strings.Contains(stderr, "division by zero") {
+		t.Errorf("Division by zero exited with %d: %s", code, stderr)
+	}
+	loop := write(t, "loop.sasm", "loop: PUSH loop\nJMP\n")
+	if code, _, _ := svm("run", "--gas", "100", loop); code != exitFault+int(vm.OutOfGas) {
+		t.Errorf("Out of gas exited with %d", code)
+	}
+	bad := write(t, "bad.sasm", "PUSH\n")
+	if code, _, stderr := svm("asm", bad); code != exitError || !strings.Contains(stderr, "bad.sasm:1:1") {
+		t.Errorf("Assembly error exited with %d: %s", code, stderr)
+	}
+	garbage := write(t, "garbage.img", "this is not an image at all")
+	if code, _, stderr := svm("run", garbage); code != exitError || !strings.Contains(stderr, "not a VM image") {
+		t.Errorf("Bad image exited with %d: %s", code, stderr)
+	}
+	for _, args := range [][]string{{}, {"bogus"}, {"run"}, {"run", "a", "b"}, {"run", "--nope", "a"}} {
+		if code, _, _ := svm(args...); code != exitUsage {
+			t.Errorf("%q exited with %d", args, code)
+		}
+	}
+	if code, _, stderr := svm("run", "--heap", "1K", "--heap-debug", write(t, "uaf.sasm", "PUSH 8\nALLOC\nDUP\nFREE\nLOAD\nHLT\n")); code != exitFault+int(vm.UseAfterFree) {
+		t.Errorf("Use after free exited with %d: %s", code, stderr)
+	}
+	// The subcommands that execute a program share the machine flags
+	for _, command := range []string{"run", "trace", "debug"} {
+		if code, _, stderr := svm(command, "--mem", "1K", fault); code != exitError || !strings.Contains(stderr, "too small") {
+			t.Errorf("%s with a small memory exited with %d: %s", command, code, stderr)
+		}
+	}
+	if code, _, _ := svm("trace", "--gas", "100", loop); code != exitFault+int(vm.OutOfGas) {
+		t.Errorf("trace out of gas exited with %d", code)
+	}
+}
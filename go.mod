@@ -1,5 +1,3 @@
 module github.com/nguyenzung/StackBasedVirtualMachine
 
 go 1.19
-
-require bou.ke/monkey v1.0.2
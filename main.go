@@ -2,8 +2,10 @@ package main
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/nguyenzung/StackBasedVirtualMachine/vm"
+	"github.com/nguyenzung/StackBasedVirtualMachine/vm/debug"
 )
 
 func main() {
@@ -36,8 +38,17 @@ func main() {
 	myVM.AddInstruction(vm.MakeOR())      // 22
 	myVM.AddInstruction(vm.MakePUSH(13))  // 23
 
+	if len(os.Args) > 1 && os.Args[1] == "debug" {
+		if err := debug.New(myVM, nil, os.Stdout).Run(os.Stdin); err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
 	myVM.DebugRom()
-	myVM.StartVM()
+	if err := myVM.StartVM(); err != nil {
+		fmt.Println("VM fault:", err)
+	}
 	myVM.DebugMemory()
 	myVM.DebugStack()
 }
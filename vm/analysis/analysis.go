@@ -0,0 +1,223 @@
+// Package analysis splits a ROM into basic blocks, links them into a control
+// flow graph and computes their stack effect from the opcode metadata of vm.
+package analysis
+
+import (
+	"sort"
+
+	"github.com/nguyenzung/StackBasedVirtualMachine/vm"
+	"github.com/nguyenzung/StackBasedVirtualMachine/vm/asm"
+)
+
+// EdgeKind tells how control goes from a block to another
+type EdgeKind int
+
+const (
+	Fallthrough EdgeKind = iota // To the next instruction, also when a conditional jump is not taken
+	Jump                        // Taken jump to a constant destination
+	Call                        // From a CALL to the entry of the callee
+	Return                      // From a CALL to the instruction after it, once the callee returns
+)
+
+var edgeNames = map[EdgeKind]string{
+	Fallthrough: "fallthrough",
+	Jump:        "jump",
+	Call:        "call",
+	Return:      "return",
+}
+
+func (kind EdgeKind) String() string {
+	return edgeNames[kind]
+}
+
+// Edge links the blocks with IDs From and To
+type Edge struct {
+	From int
+	To   int
+	Kind EdgeKind
+}
+
+// Block is a run of instructions only entered at the first one and only left
+// at the last one
+type Block struct {
+	ID           int
+	Start        uint64 // Index of the first instruction
+	End          uint64 // Index following the last instruction
+	Instructions []asm.Instruction
+	Pops         int  // Values the block needs on the stack when it is entered
+	Pushes       int  // Values on the stack in their place when it is left
+	Dynamic      bool // Holds a CALL or a SYSCALL, whose full effect is not counted
+	Reachable    bool // Can be reached from the entry of the graph
+	Succs        []Edge
+	Preds        []Edge
+}
+
+// Effect is the change of the stack height from the entry of the block to
+// its exit
+func (block *Block) Effect() int {
+	return block.Pushes - block.Pops
+}
+
+// Graph is the control flow graph of a ROM
+type Graph struct {
+	Entry      int // ID of the block holding the entry point, -1 when it is not an instruction
+	Blocks     []*Block
+	Edges      []Edge
+	Functions  []uint64 // Indices called by CALL, sorted
+	Unresolved []uint64 // Indices of the jumps whose destination is not a constant instruction index
+}
+
+// Build decodes rom and returns its graph, execution starts at entry. A jump
+// destination is resolved when a PUSH or PUSH64 right before the jump in the
+// same block provides it.
+func Build(rom []uint64, entry uint64) *Graph {
+	instructions := asm.Disassemble(rom)
+	starts := make(map[uint64]int)
+	for i, ins := range instructions {
+		starts[ins.Index] = i
+	}
+
+	leaders := map[uint64]bool{entry: true}
+	functions := make(map[uint64]bool)
+	for i, ins := range instructions {
+		if ins.HasTarget {
+			if _, ok := starts[ins.Target]; ok {
+				leaders[ins.Target] = true
+			}
+			if ins.Opcode == vm.CALL {
+				functions[ins.Target] = true
+			}
+		}
+		if endsBlock(ins) && i+1 < len(instructions) {
+			leaders[instructions[i+1].Index] = true
+		}
+	}
+
+	g := &Graph{Entry: -1}
+	blockAt := make(map[uint64]int)
+	for i, ins := range instructions {
+		if i == 0 || leaders[ins.Index] {
+			block := &Block{ID: len(g.Blocks), Start: ins.Index}
+			g.Blocks = append(g.Blocks, block)
+			blockAt[ins.Index] = block.ID
+		}
+		block := g.Blocks[len(g.Blocks)-1]
+		block.Instructions = append(block.Instructions, ins)
+		block.End = ins.Index + uint64(ins.Words)
+	}
+	if id, ok := blockAt[entry]; ok {
+		g.Entry = id
+	}
+	for index := range functions {
+		g.Functions = append(g.Functions, index)
+	}
+	sort.Slice(g.Functions, func(i, j int) bool { return g.Functions[i] < g.Functions[j] })
+
+	for _, block := range g.Blocks {
+		block.computeEffect()
+		g.link(block, blockAt)
+	}
+	g.markReachable()
+	return g
+}
+
+// endsBlock reports whether control may leave the instruction other than by
+// falling through to the next one
+func endsBlock(ins asm.Instruction) bool {
+	if !ins.Known() || ins.Truncated {
+		return true
+	}
+	info, _ := vm.LookupOpcode(ins.Opcode)
+	return info.Jump || ins.Opcode == vm.CALL || ins.Opcode == vm.RET || ins.Opcode == vm.HLT
+}
+
+// computeEffect adds up the stack effects of the instructions of block
+func (block *Block) computeEffect() {
+	height := 0
+	for _, ins := range block.Instructions {
+		info, ok := vm.LookupOpcode(ins.Opcode)
+		if !ok {
+			continue
+		}
+		if height-info.Pops < -block.Pops {
+			block.Pops = info.Pops - height
+		}
+		height += info.Pushes - info.Pops
+		if info.Dynamic {
+			block.Dynamic = true
+		}
+	}
+	block.Pushes = block.Pops + height
+}
+
+// link adds the edges leaving block
+func (g *Graph) link(block *Block, blockAt map[uint64]int) {
+	last := block.Instructions[len(block.Instructions)-1]
+	next, hasNext := blockAt[block.End]
+	if !last.Known() || last.Truncated {
+		return
+	}
+	info, _ := vm.LookupOpcode(last.Opcode)
+	switch {
+	case last.Opcode == vm.RET || last.Opcode == vm.HLT:
+	case last.Opcode == vm.CALL:
+		if callee, ok := blockAt[last.Target]; ok {
+			g.addEdge(block.ID, callee, Call)
+		}
+		if hasNext {
+			g.addEdge(block.ID, next, Return)
+		}
+	case info.Jump:
+		resolved := false
+		if n := len(block.Instructions); n > 1 && block.Instructions[n-2].HasTarget {
+			if to, ok := blockAt[block.Instructions[n-2].Target]; ok {
+				g.addEdge(block.ID, to, Jump)
+				resolved = true
+			}
+		}
+		if !resolved {
+			g.Unresolved = append(g.Unresolved, last.Index)
+		}
+		if last.Opcode != vm.JMP && hasNext {
+			g.addEdge(block.ID, next, Fallthrough)
+		}
+	case hasNext:
+		g.addEdge(block.ID, next, Fallthrough)
+	}
+}
+
+func (g *Graph) addEdge(from int, to int, kind EdgeKind) {
+	edge := Edge{From: from, To: to, Kind: kind}
+	g.Edges = append(g.Edges, edge)
+	g.Blocks[from].Succs = append(g.Blocks[from].Succs, edge)
+	g.Blocks[to].Preds = append(g.Blocks[to].Preds, edge)
+}
+
+func (g *Graph) markReachable() {
+	if g.Entry < 0 {
+		return
+	}
+	work := []int{g.Entry}
+	g.Blocks[g.Entry].Reachable = true
+	for len(work) > 0 {
+		block := g.Blocks[work[len(work)-1]]
+		work = work[:len(work)-1]
+		for _, edge := range block.Succs {
+			if to := g.Blocks[edge.To]; !to.Reachable {
+				to.Reachable = true
+				work = append(work, to.ID)
+			}
+		}
+	}
+}
+
+// BlockAt returns the block holding the instruction at index, or nil
+func (g *Graph) BlockAt(index uint64) *Block {
+	i := sort.Search(len(g.Blocks), func(i int) bool {
+		return g.Blocks[i].End > index
+	})
+	if i < len(g.Blocks) && g.Blocks[i].Start <= index {
+		return g.Blocks[i]
+	}
+	return nil
+}
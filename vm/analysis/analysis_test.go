@@ -0,0 +1,119 @@
+package analysis
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nguyenzung/StackBasedVirtualMachine/vm"
+	"github.com/nguyenzung/StackBasedVirtualMachine/vm/asm"
+)
+
+const program = `
+.entry main
+double:	PUSH 0        ; 0
+	SLOAD
+	DUP
+	ADD
+	RET           ; 4
+main:	PUSH 3        ; 5
+	PUSH 1
+	CALL double   ; 7
+	DUP           ; 8
+	PUSH 20
+	GT
+	PUSH done
+	JNZ           ; 12
+	PUSH 1        ; 13
+	CALL double
+	PUSH main     ; 15
+	JMP
+done:	HLT           ; 17
+	PUSH 1        ; 18
+	SPACE
+	JMP
+`
+
+func build(t *testing.T) (*Graph, *asm.Program) {
+	p, err := asm.Assemble([]byte(program))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Build(p.Code, p.Entry), p
+}
+
+func TestBuild(t *testing.T) {
+	g, _ := build(t)
+	var starts []uint64
+	for _, block := range g.Blocks {
+		starts = append(starts, block.Start)
+	}
+	if expected := []uint64{0, 5, 8, 13, 15, 17, 18}; !reflect.DeepEqual(starts, expected) {
+		t.Fatalf("Blocks start at %v, expected %v", starts, expected)
+	}
+	if g.Entry != 1 || !reflect.DeepEqual(g.Functions, []uint64{0}) || !reflect.DeepEqual(g.Unresolved, []uint64{20}) {
+		t.Errorf("Entry %d, functions %v, unresolved %v", g.Entry, g.Functions, g.Unresolved)
+	}
+
+	expected := []Edge{
+		{1, 0, Call}, {1, 2, Return},
+		{2, 5, Jump}, {2, 3, Fallthrough},
+		{3, 0, Call}, {3, 4, Return},
+		{4, 1, Jump},
+	}
+	if !reflect.DeepEqual(g.Edges, expected) {
+		t.Errorf("Edges %v, expected %v", g.Edges, expected)
+	}
+	if preds := g.Blocks[0].Preds; len(preds) != 2 || preds[0].From != 1 || preds[1].From != 3 {
+		t.Errorf("Unexpected predecessors of double %v", preds)
+	}
+
+	effects := [][2]int{{0, 1}, {0, 1}, {1, 1}, {0, 0}, {0, 0}, {0, 0}, {0, 1}}
+	for i, block := range g.Blocks {
+		if [2]int{block.Pops, block.Pushes} != effects[i] {
+			t.Errorf("Block %d pops %d and pushes %d, expected %v", i, block.Pops, block.Pushes, effects[i])
+		}
+	}
+	if !g.Blocks[1].Dynamic || g.Blocks[2].Dynamic || g.Blocks[2].Effect() != 0 {
+		t.Errorf("Unexpected effect of blocks 1 and 2")
+	}
+	for i, block := range g.Blocks {
+		if block.Reachable != (i < 6) {
+			t.Errorf("Block %d reachable is %v", i, block.Reachable)
+		}
+	}
+	if g.BlockAt(11) != g.Blocks[2] || g.BlockAt(20) != g.Blocks[6] || g.BlockAt(21) != nil {
+		t.Errorf("BlockAt returns the wrong blocks")
+	}
+
+	if g := Build(append(vm.MakePUSH64(1), vm.MakeJMP()), 1); g.Entry != -1 || len(g.Blocks) != 1 || !reflect.DeepEqual(g.Unresolved, []uint64{2}) {
+		t.Errorf("Entry in an immediate gives %+v", g)
+	}
+}
+
+func TestWriteDot(t *testing.T) {
+	g, p := build(t)
+	var out bytes.Buffer
+	if err := g.WriteDot(&out, p.Labels); err != nil {
+		t.Fatal(err)
+	}
+	dot := out.String()
+	for _, want := range []string{
+		"digraph rom {\n",
+		"\tb0 [label=\"double:\\l0000  PUSH 0\\l",
+		"0004  RET\\lpops 0, pushes 1\\l\"];\n",
+		"\tb1 [label=\"main:\\l0005  PUSH 3\\l0006  PUSH 1\\l0007  CALL 0\\lpops 0, pushes 1 dynamic\\l\", penwidth=2];\n",
+		"\tb6 [label=\"0018  PUSH 1\\l0019  SPACE\\l0020  JMP\\lpops 0, pushes 1\\l\", color=\"gray\", fontcolor=\"gray\"];\n",
+		"\tb1 -> b0 [style=\"dashed\", label=\"call\"];\n",
+		"\tb2 -> b5 [color=\"blue\"];\n",
+		"\tb2 -> b3;\n",
+	} {
+		if !strings.Contains(dot, want) {
+			t.Errorf("DOT output lacks %q:\n%s", want, dot)
+		}
+	}
+	if !strings.HasSuffix(dot, "}\n") {
+		t.Errorf("Unterminated DOT output:\n%s", dot)
+	}
+}
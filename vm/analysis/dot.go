@@ -0,0 +1,83 @@
+package analysis
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/nguyenzung/StackBasedVirtualMachine/vm"
+	"github.com/nguyenzung/StackBasedVirtualMachine/vm/asm"
+)
+
+// Attributes of the edges of each kind in DOT
+var edgeStyles = map[EdgeKind]string{
+	Fallthrough: "",
+	Jump:        ` [color="blue"]`,
+	Call:        ` [style="dashed", label="call"]`,
+	Return:      ` [style="dotted", label="return"]`,
+}
+
+// WriteDot writes g as a Graphviz digraph. Each node lists the instructions
+// of a block under its labels, taken from labels when given, and its stack
+// effect. Unreachable blocks are grayed out.
+func (g *Graph) WriteDot(w io.Writer, labels map[string]uint64) error {
+	names := make(map[uint64][]string)
+	for name, index := range labels {
+		names[index] = append(names[index], name)
+	}
+	for _, list := range names {
+		sort.Strings(list)
+	}
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "digraph rom {\n")
+	fmt.Fprintf(out, "\tnode [shape=box, fontname=\"monospace\"];\n")
+	for _, block := range g.Blocks {
+		var label strings.Builder
+		for _, name := range names[block.Start] {
+			fmt.Fprintf(&label, "%s:\\l", name)
+		}
+		for _, ins := range block.Instructions {
+			fmt.Fprintf(&label, "%04d  %s\\l", ins.Index, escape(format(ins)))
+		}
+		dynamic := ""
+		if block.Dynamic {
+			dynamic = " dynamic"
+		}
+		fmt.Fprintf(&label, "pops %d, pushes %d%s\\l", block.Pops, block.Pushes, dynamic)
+		attributes := ""
+		if block.ID == g.Entry {
+			attributes = ", penwidth=2"
+		}
+		if !block.Reachable {
+			attributes += ", color=\"gray\", fontcolor=\"gray\""
+		}
+		fmt.Fprintf(out, "\tb%d [label=\"%s\"%s];\n", block.ID, label.String(), attributes)
+	}
+	for _, edge := range g.Edges {
+		fmt.Fprintf(out, "\tb%d -> b%d%s;\n", edge.From, edge.To, edgeStyles[edge.Kind])
+	}
+	fmt.Fprintf(out, "}\n")
+	return out.Flush()
+}
+
+// format prints an instruction with its operand as a number
+func format(ins asm.Instruction) string {
+	if !ins.Known() || ins.Truncated {
+		return fmt.Sprintf(".word 0x%016x", ins.Word)
+	}
+	info, _ := vm.LookupOpcode(ins.Opcode)
+	switch {
+	case info.Wide:
+		return fmt.Sprintf("%s 0x%x", ins.Name, ins.Operand)
+	case info.Operand:
+		return fmt.Sprintf("%s %d", ins.Name, ins.Operand)
+	}
+	return ins.Name
+}
+
+func escape(text string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(text)
+}
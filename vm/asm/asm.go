@@ -0,0 +1,496 @@
+// Package asm translates the text form of the vm instruction set into ROM
+// images that can be flashed with VM.FlashRom.
+//
+// A source file holds one statement per line:
+//
+//	; comments start with ';' or '#'
+//	.equ N 1000          ; named constant
+//	start:               ; label, its value is the index of the next instruction
+//	    PUSH loop        ; operands are numbers, characters ('a') or symbols
+//	    JMP
+//	loop: PUSH 0x10      ; a label may share the line with an instruction
+//	    .word 0xff       ; raw 64 bit ROM word
+//	    PUSHF -2.5       ; PUSHF takes a float literal
+//	    PUSH64 -1        ; any 64 bit value, negative numbers are two's complement
+//	.entry start         ; instruction where execution starts, 0 by default
+//
+// The .data directive switches to the initialized data segment and .text
+// back to code. Labels in the data segment are byte offsets usable by LOAD
+// and STORE, and data is laid out with
+//
+//	.data
+//	msg:  .ascii "hi\n"  ; bytes of a string, .asciz adds a 0 terminator
+//	      .byte 1, 2, -1  ; bytes
+//	      .word 1, N      ; little endian 64 bit words
+//	buf:  .zero 16        ; zeroed bytes
+//
+// Mnemonics are case insensitive and match the opcode names in the vm
+// package. Numbers may be written in decimal, hex (0x), octal (0o) or
+// binary (0b).
+package asm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/nguyenzung/StackBasedVirtualMachine/vm"
+)
+
+// Program is the result of assembling a source file
+type Program struct {
+	Code       []uint64
+	Labels     map[string]uint64 // Instruction index of every code label
+	Data       []byte
+	DataLabels map[string]uint64 // Data segment offset of every data label
+	Entry      uint64
+}
+
+// Image packs the program in the format of vm.WriteImage
+func (p *Program) Image() *vm.Image {
+	return &vm.Image{Version: vm.ISAVersion, Entry: p.Entry, Code: p.Code, Data: p.Data, Symbols: p.Labels}
+}
+
+// Error reports a problem at a position in the source, lines and columns start at 1
+type Error struct {
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Msg)
+}
+
+type token struct {
+	text   string
+	column int
+}
+
+type statement struct {
+	line      int
+	mnemonic  token
+	opcode    uint8
+	directive bool
+	arg       *token
+	words     int
+	data      []token // Values of a data segment directive
+	size      int     // Number of data segment bytes
+}
+
+type assembler struct {
+	program    *Program
+	constants  map[string]uint64
+	statements []statement
+	words      int
+	inData     bool // Statements go to the data segment
+	dataSize   int
+	entry      *token
+	entryLine  int
+}
+
+// Assemble translates src into a program
+func Assemble(src []byte) (*Program, error) {
+	a := &assembler{
+		program: &Program{
+			Code:       make([]uint64, 0),
+			Labels:     make(map[string]uint64),
+			Data:       make([]byte, 0),
+			DataLabels: make(map[string]uint64),
+		},
+		constants: make(map[string]uint64),
+	}
+	lines := strings.Split(string(src), "\n")
+	for i, line := range lines {
+		if err := a.parseLine(i+1, line); err != nil {
+			return nil, err
+		}
+	}
+	for _, stmt := range a.statements {
+		if err := a.emit(stmt); err != nil {
+			return nil, err
+		}
+	}
+	if a.entry != nil {
+		entry, err := a.resolve(a.entryLine, *a.entry, a.constants, a.program.Labels)
+		if err != nil {
+			return nil, err
+		}
+		if entry >= uint64(len(a.program.Code)) {
+			return nil, &Error{Line: a.entryLine, Column: a.entry.column, Msg: fmt.Sprintf("entry point %s is outside the code", a.entry.text)}
+		}
+		a.program.Entry = entry
+	}
+	return a.program, nil
+}
+
+// parseLine records labels and constants and queues the statement of a line
+// for the second pass, once every label address is known
+func (a *assembler) parseLine(line int, text string) error {
+	tokens, err := tokenize(line, text)
+	if err != nil {
+		return err
+	}
+	for len(tokens) > 0 && strings.HasSuffix(tokens[0].text, ":") {
+		name := token{text: strings.TrimSuffix(tokens[0].text, ":"), column: tokens[0].column}
+		var err error
+		if a.inData {
+			err = a.define(line, name, uint64(a.dataSize), a.program.DataLabels)
+		} else {
+			err = a.define(line, name, uint64(a.size()), a.program.Labels)
+		}
+		if err != nil {
+			return err
+		}
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	head := tokens[0]
+	switch strings.ToLower(head.text) {
+	case ".equ":
+		if len(tokens) != 3 {
+			return &Error{Line: line, Column: head.column, Msg: ".equ expects a name and a value"}
+		}
+		value, err := a.resolve(line, tokens[2], a.constants)
+		if err != nil {
+			return err
+		}
+		return a.define(line, tokens[1], value, a.constants)
+	case ".text", ".data":
+		if len(tokens) != 1 {
+			return &Error{Line: line, Column: tokens[1].column, Msg: fmt.Sprintf("unexpected %s", tokens[1].text)}
+		}
+		a.inData = strings.ToLower(head.text) == ".data"
+		return nil
+	case ".entry":
+		if len(tokens) != 2 {
+			return &Error{Line: line, Column: head.column, Msg: ".entry expects one label"}
+		}
+		if a.entry != nil {
+			return &Error{Line: line, Column: head.column, Msg: fmt.Sprintf("entry point already set on line %d", a.entryLine)}
+		}
+		a.entry, a.entryLine = &tokens[1], line
+		return nil
+	}
+	if a.inData {
+		return a.parseData(line, tokens)
+	}
+	switch strings.ToLower(head.text) {
+	case ".word":
+		if len(tokens) != 2 {
+			return &Error{Line: line, Column: head.column, Msg: ".word expects one value"}
+		}
+		a.queue(statement{line: line, mnemonic: head, directive: true, arg: &tokens[1], words: 1})
+		return nil
+	}
+	if strings.HasPrefix(head.text, ".") {
+		return &Error{Line: line, Column: head.column, Msg: fmt.Sprintf("unknown directive %s", head.text)}
+	}
+
+	opcode, ok := vm.OpcodeByName(strings.ToUpper(head.text))
+	if !ok {
+		return &Error{Line: line, Column: head.column, Msg: fmt.Sprintf("unknown instruction %s", head.text)}
+	}
+	info, _ := vm.LookupOpcode(opcode)
+	stmt := statement{line: line, mnemonic: head, opcode: opcode, words: info.Words()}
+	hasArg := info.Operand || info.Wide
+	switch {
+	case hasArg && len(tokens) == 1:
+		return &Error{Line: line, Column: head.column, Msg: fmt.Sprintf("%s expects an operand", info.Name)}
+	case !hasArg && len(tokens) > 1:
+		return &Error{Line: line, Column: tokens[1].column, Msg: fmt.Sprintf("%s takes no operand", info.Name)}
+	case len(tokens) > 2:
+		return &Error{Line: line, Column: tokens[2].column, Msg: fmt.Sprintf("unexpected %s", tokens[2].text)}
+	}
+	if hasArg {
+		stmt.arg = &tokens[1]
+	}
+	if opcode == vm.PUSHF {
+		// Floats that lose bits in the operand are pushed with PUSH64 instead
+		value, err := parseFloat(tokens[1].text)
+		if err != nil {
+			return &Error{Line: line, Column: tokens[1].column, Msg: err.Error()}
+		}
+		if !vm.FloatFitsOperand(value) {
+			stmt.words = 2
+		}
+	}
+	a.queue(stmt)
+	return nil
+}
+
+// parseData queues a directive of the data segment, its size must be known
+// in the first pass to place the labels that follow it
+func (a *assembler) parseData(line int, tokens []token) error {
+	head := tokens[0]
+	name := strings.ToLower(head.text)
+	stmt := statement{line: line, mnemonic: head, directive: true, data: tokens[1:]}
+	if len(stmt.data) == 0 {
+		return &Error{Line: line, Column: head.column, Msg: fmt.Sprintf("%s expects a value", name)}
+	}
+	switch name {
+	case ".byte":
+		stmt.size = len(stmt.data)
+	case ".word":
+		stmt.size = 8 * len(stmt.data)
+	case ".ascii", ".asciz":
+		if len(stmt.data) != 1 {
+			return &Error{Line: line, Column: stmt.data[1].column, Msg: fmt.Sprintf("unexpected %s", stmt.data[1].text)}
+		}
+		text, err := parseString(stmt.data[0].text)
+		if err != nil {
+			return &Error{Line: line, Column: stmt.data[0].column, Msg: err.Error()}
+		}
+		stmt.size = len(text)
+		if name == ".asciz" {
+			stmt.size++
+		}
+	case ".zero":
+		if len(stmt.data) != 1 {
+			return &Error{Line: line, Column: stmt.data[1].column, Msg: fmt.Sprintf("unexpected %s", stmt.data[1].text)}
+		}
+		// Labels that follow are not defined yet, so only constants are allowed
+		size, err := a.resolve(line, stmt.data[0], a.constants)
+		if err != nil {
+			return err
+		}
+		if size > vm.MaxImageSize {
+			return &Error{Line: line, Column: stmt.data[0].column, Msg: fmt.Sprintf("size %s exceeds the 4GB image limit", stmt.data[0].text)}
+		}
+		stmt.size = int(size)
+	default:
+		if strings.HasPrefix(head.text, ".") {
+			return &Error{Line: line, Column: head.column, Msg: fmt.Sprintf("unknown directive %s", head.text)}
+		}
+		return &Error{Line: line, Column: head.column, Msg: fmt.Sprintf("instruction %s in the data segment", head.text)}
+	}
+	if uint64(a.dataSize)+uint64(stmt.size) > vm.MaxImageSize {
+		return &Error{Line: line, Column: head.column, Msg: "data segment exceeds the 4GB image limit"}
+	}
+	a.statements = append(a.statements, stmt)
+	a.dataSize += stmt.size
+	return nil
+}
+
+func (a *assembler) queue(stmt statement) {
+	a.statements = append(a.statements, stmt)
+	a.words += stmt.words
+}
+
+// emitData appends the bytes of a data segment directive
+func (a *assembler) emitData(stmt statement) error {
+	name := strings.ToLower(stmt.mnemonic.text)
+	switch name {
+	case ".ascii", ".asciz":
+		text, _ := parseString(stmt.data[0].text)
+		a.program.Data = append(a.program.Data, text...)
+		if name == ".asciz" {
+			a.program.Data = append(a.program.Data, 0)
+		}
+		return nil
+	case ".zero":
+		a.program.Data = append(a.program.Data, make([]byte, stmt.size)...)
+		return nil
+	}
+	for _, arg := range stmt.data {
+		value, err := a.resolve(stmt.line, arg, a.constants, a.program.Labels, a.program.DataLabels)
+		if err != nil {
+			return err
+		}
+		if name == ".word" {
+			a.program.Data = binary.LittleEndian.AppendUint64(a.program.Data, value)
+			continue
+		}
+		// Negative bytes are accepted as two's complement
+		if value > 0xff && value < math.MaxUint64-0x7f {
+			return &Error{Line: stmt.line, Column: arg.column, Msg: fmt.Sprintf("byte %s out of range", arg.text)}
+		}
+		a.program.Data = append(a.program.Data, byte(value))
+	}
+	return nil
+}
+
+func (a *assembler) emit(stmt statement) error {
+	if stmt.data != nil {
+		return a.emitData(stmt)
+	}
+	if stmt.opcode == vm.PUSHF && !stmt.directive {
+		return a.emitFloat(stmt)
+	}
+	var operand uint64
+	if stmt.arg != nil {
+		value, err := a.resolve(stmt.line, *stmt.arg, a.constants, a.program.Labels, a.program.DataLabels)
+		if err != nil {
+			return err
+		}
+		operand = value
+	}
+	if stmt.directive {
+		a.program.Code = append(a.program.Code, operand)
+		return nil
+	}
+	if stmt.words == 2 {
+		a.program.Code = append(a.program.Code, vm.Encode(stmt.opcode, 0), operand)
+		return nil
+	}
+	if operand > vm.MaxOperand {
+		return &Error{Line: stmt.line, Column: stmt.arg.column, Msg: fmt.Sprintf("operand %s does not fit in 56 bits, use PUSH64", stmt.arg.text)}
+	}
+	a.program.Code = append(a.program.Code, vm.Encode(stmt.opcode, operand))
+	return nil
+}
+
+// emitFloat encodes PUSHF, whose operand is a float literal rather than an integer
+func (a *assembler) emitFloat(stmt statement) error {
+	value, _ := parseFloat(stmt.arg.text)
+	if stmt.words == 2 {
+		a.program.Code = append(a.program.Code, vm.MakePUSH64(math.Float64bits(value))...)
+		return nil
+	}
+	a.program.Code = append(a.program.Code, vm.MakePUSHF(value))
+	return nil
+}
+
+// size is the number of ROM words queued so far
+func (a *assembler) size() int {
+	return a.words
+}
+
+// define binds name to value in symbols, labels and constants share one namespace
+func (a *assembler) define(line int, name token, value uint64, symbols map[string]uint64) error {
+	if !isIdentifier(name.text) {
+		return &Error{Line: line, Column: name.column, Msg: fmt.Sprintf("invalid symbol name %q", name.text)}
+	}
+	_, isLabel := a.program.Labels[name.text]
+	_, isData := a.program.DataLabels[name.text]
+	_, isConstant := a.constants[name.text]
+	if isLabel || isData || isConstant {
+		return &Error{Line: line, Column: name.column, Msg: fmt.Sprintf("%s redefined", name.text)}
+	}
+	symbols[name.text] = value
+	return nil
+}
+
+// resolve evaluates a number, character or symbol looked up in scopes
+func (a *assembler) resolve(line int, arg token, scopes ...map[string]uint64) (uint64, error) {
+	text := arg.text
+	if strings.HasPrefix(text, "'") {
+		value, err := parseChar(text)
+		if err != nil {
+			return 0, &Error{Line: line, Column: arg.column, Msg: err.Error()}
+		}
+		return value, nil
+	}
+	digits := strings.TrimPrefix(text, "-")
+	if digits != "" && unicode.IsDigit(rune(digits[0])) {
+		value, err := strconv.ParseUint(digits, 0, 64)
+		if err != nil {
+			return 0, &Error{Line: line, Column: arg.column, Msg: fmt.Sprintf("invalid number %s", text)}
+		}
+		if digits != text {
+			value = -value
+		}
+		return value, nil
+	}
+	for _, scope := range scopes {
+		if value, ok := scope[text]; ok {
+			return value, nil
+		}
+	}
+	return 0, &Error{Line: line, Column: arg.column, Msg: fmt.Sprintf("undefined symbol %s", text)}
+}
+
+// parseFloat accepts the syntax of strconv.ParseFloat, NaN is encoded as the
+// quiet NaN with an empty payload so that it fits a PUSHF operand
+func parseFloat(text string) (float64, error) {
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid float %s", text)
+	}
+	if math.IsNaN(value) {
+		return math.Float64frombits(quietNaN), nil
+	}
+	return value, nil
+}
+
+const quietNaN uint64 = 0x7ff8000000000000
+
+func parseString(text string) (string, error) {
+	if !strings.HasPrefix(text, "\"") {
+		return "", fmt.Errorf("invalid string literal %s", text)
+	}
+	value, err := strconv.Unquote(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid string literal %s", text)
+	}
+	return value, nil
+}
+
+func parseChar(text string) (uint64, error) {
+	if len(text) < 3 || !strings.HasSuffix(text, "'") {
+		return 0, fmt.Errorf("invalid character literal %s", text)
+	}
+	value, _, tail, err := strconv.UnquoteChar(text[1:len(text)-1], '\'')
+	if err != nil || tail != "" {
+		return 0, fmt.Errorf("invalid character literal %s", text)
+	}
+	return uint64(value), nil
+}
+
+func isIdentifier(text string) bool {
+	if text == "" {
+		return false
+	}
+	for i, r := range text {
+		if r == '_' || unicode.IsLetter(r) || (i > 0 && unicode.IsDigit(r)) {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// tokenize splits a line on white space and drops its comment, character
+// and string literals are kept whole so that ';' and '#' can be written in them
+func tokenize(line int, text string) ([]token, error) {
+	tokens := make([]token, 0, 3)
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case r == ';' || r == '#':
+			return tokens, nil
+		case unicode.IsSpace(r) || r == ',':
+			i++
+		case r == '\'' || r == '"':
+			start := i
+			for i++; i < len(runes) && runes[i] != r; i++ {
+				if runes[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(runes) {
+				kind := "character"
+				if r == '"' {
+					kind = "string"
+				}
+				return nil, &Error{Line: line, Column: start + 1, Msg: fmt.Sprintf("unterminated %s literal", kind)}
+			}
+			i++
+			tokens = append(tokens, token{text: string(runes[start:i]), column: start + 1})
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune(";#,'\"", runes[i]) {
+				i++
+			}
+			tokens = append(tokens, token{text: string(runes[start:i]), column: start + 1})
+		}
+	}
+	return tokens, nil
+}
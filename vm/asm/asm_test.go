@@ -0,0 +1,239 @@
+package asm
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/nguyenzung/StackBasedVirtualMachine/vm"
+)
+
+func TestAssemble(t *testing.T) {
+	src := `
+; sum two numbers and jump over the trap
+.equ N 0x10
+start:
+	push N
+	PUSH 0b101   # binary
+	add
+	push done
+	jmp
+trap: PUSH 'x'
+	HLT
+done:
+	CALL trap
+	.word 0xffffffffffffffff
+`
+	program, err := Assemble([]byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []uint64{
+		vm.MakePUSH(16),
+		vm.MakePUSH(5),
+		vm.MakeADD(),
+		vm.MakePUSH(7),
+		vm.MakeJMP(),
+		vm.MakePUSH('x'),
+		vm.MakeHLT(),
+		vm.MakeCALL(5),
+		0xffffffffffffffff,
+	}
+	if len(program.Code) != len(expected) {
+		t.Fatalf("Code has %d words, expected %d", len(program.Code), len(expected))
+	}
+	for i, word := range expected {
+		if program.Code[i] != word {
+			t.Errorf("Word %d is %x, expected %x", i, program.Code[i], word)
+		}
+	}
+	labels := map[string]uint64{"start": 0, "trap": 5, "done": 7}
+	for name, index := range labels {
+		if program.Labels[name] != index {
+			t.Errorf("Label %s at %d, expected %d", name, program.Labels[name], index)
+		}
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	cases := []struct {
+		src    string
+		line   int
+		column int
+	}{
+		{"PUSH 1\n  FOO", 2, 3},
+		{"PUSH", 1, 1},
+		{"ADD 1", 1, 5},
+		{"PUSH missing", 1, 6},
+		{"PUSH 0x100000000000000", 1, 6},
+		{"a:\na:", 2, 1},
+		{"PUSH 12z", 1, 6},
+		{"PUSH 'ab'", 1, 6},
+		{"  .bogus 1", 1, 3},
+		{"PUSH 1 2", 1, 8},
+		{"PUSH -1", 1, 6},
+		{"PUSH64", 1, 1},
+		{"PUSHF x", 1, 7},
+		{".data\nPUSH 1", 2, 1},
+		{".data\n.byte 256", 2, 7},
+		{".data\n.ascii \"abc", 2, 8},
+		{".data\n.zero later\nlater:", 2, 7},
+		{".data\n.zero 0xffffffffffffff", 2, 7},
+		{".data\n.zero 0x80000000\n.zero 0x80000000", 3, 1},
+		{"HLT\n.entry nowhere", 2, 8},
+		{"HLT\n.entry 5", 2, 8},
+		{".entry a\n.entry b", 2, 1},
+	}
+	for _, c := range cases {
+		_, err := Assemble([]byte(c.src))
+		asmErr, ok := err.(*Error)
+		if !ok {
+			t.Errorf("%q: expected *Error, got %v", c.src, err)
+			continue
+		}
+		if asmErr.Line != c.line || asmErr.Column != c.column {
+			t.Errorf("%q: error at %d:%d, expected %d:%d (%s)", c.src, asmErr.Line, asmErr.Column, c.line, c.column, asmErr.Msg)
+		}
+	}
+}
+
+func TestDisassembleRoundTrip(t *testing.T) {
+	code := []uint64{
+		vm.MakeHLT(),
+		vm.MakePUSH(1),
+		vm.MakePUSH(5),
+		vm.MakeJNZ(),
+		vm.MakeCALL(6),
+		0x00000000000000ff,
+		vm.MakePUSH(99),
+		vm.MakeRET(),
+	}
+	machine := vm.MakeVM(8 * 10000000)
+	machine.FlashRom(code)
+	machine.StartVM()
+	loaded := machine.ReadRom()
+
+	var out strings.Builder
+	if err := Fprint(&out, loaded, nil); err != nil {
+		t.Fatal(err)
+	}
+	text := out.String()
+	for _, expected := range []string{"L0005:\n", "PUSH L0005", "CALL L0006", ".word 0x00000000000000ff", "unknown opcode 0x00", "PUSH 99 "} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("Listing misses %q:\n%s", expected, text)
+		}
+	}
+
+	program, err := Assemble([]byte(text))
+	if err != nil {
+		t.Fatalf("%v\n%s", err, text)
+	}
+	for i, word := range code {
+		if program.Code[i] != word {
+			t.Errorf("Word %d is %x after round trip, expected %x", i, program.Code[i], word)
+		}
+	}
+}
+
+func TestFloatRoundTrip(t *testing.T) {
+	program, err := Assemble([]byte("PUSHF -2.5\nPUSHF 1e10\nPUSHF +Inf\nPUSHF NaN\nPUSHF 3.14\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if program.Code[0] != vm.MakePUSHF(-2.5) || program.Code[1] != vm.MakePUSHF(1e10) {
+		t.Errorf("Unexpected encoding %x", program.Code)
+	}
+	if pi := vm.MakePUSH64(math.Float64bits(3.14)); program.Code[4] != pi[0] || program.Code[5] != pi[1] {
+		t.Errorf("PUSHF 3.14 is not widened to PUSH64: %x", program.Code[4:])
+	}
+	var out strings.Builder
+	if err := Fprint(&out, program.Code, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"PUSHF -2.5 ", "PUSHF 1e+10 ", "PUSHF +Inf ", "PUSHF NaN "} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Listing misses %q:\n%s", expected, out.String())
+		}
+	}
+	again, err := Assemble([]byte(out.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, word := range program.Code {
+		if again.Code[i] != word {
+			t.Errorf("Word %d is %x after round trip, expected %x", i, again.Code[i], word)
+		}
+	}
+}
+
+func TestPUSH64(t *testing.T) {
+	src := `
+	PUSH64 -1
+	PUSH64 0x123456789abcdef0
+	PUSH64 end
+	JMP
+end:
+	PUSH64 7
+`
+	program, err := Assemble([]byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append(vm.MakePUSH64(0xffffffffffffffff), vm.MakePUSH64(0x123456789abcdef0)...)
+	expected = append(expected, vm.MakePUSH64(7)...)
+	expected = append(expected, vm.MakeJMP())
+	expected = append(expected, vm.MakePUSH64(7)...)
+	if len(program.Code) != len(expected) {
+		t.Fatalf("Code has %d words, expected %d", len(program.Code), len(expected))
+	}
+	for i, word := range expected {
+		if program.Code[i] != word {
+			t.Errorf("Word %d is %x, expected %x", i, program.Code[i], word)
+		}
+	}
+
+	var out strings.Builder
+	if err := Fprint(&out, append(program.Code, vm.MakePUSH64(0)[0]), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"L0007:\n", "PUSH64 L0007", "PUSH64 0xffffffffffffffff", "PUSH64 without its immediate"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Listing misses %q:\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestAssembleData(t *testing.T) {
+	src := `
+.equ SIZE 4
+.entry main
+.data
+msg:	.asciz "hi;"
+	.byte 1, -1
+words:	.word 0x0102, msg
+buf:	.zero SIZE
+end:
+.text
+helper:	RET
+main:	PUSH words
+	LOAD
+	PUSH end
+`
+	program, err := Assemble([]byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append([]byte{'h', 'i', ';', 0, 1, 0xff, 2, 1}, make([]byte, 6+8+4)...)
+	if string(program.Data) != string(data) {
+		t.Errorf("Data is %v, expected %v", program.Data, data)
+	}
+	if program.DataLabels["words"] != 6 || program.DataLabels["buf"] != 22 || program.DataLabels["end"] != 26 {
+		t.Errorf("Unexpected data labels %v", program.DataLabels)
+	}
+	if _, ok := program.Labels["msg"]; ok {
+		t.Errorf("Data label msg is a code label")
+	}
+	if program.Entry != 1 || program.Code[1] != vm.MakePUSH(6) || program.Code[3] != vm.MakePUSH(26) {
+		t.Errorf("Unexpected code %x with entry %d", program.Code, program.Entry)
+	}
+}
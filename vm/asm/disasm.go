@@ -0,0 +1,134 @@
+package asm
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/nguyenzung/StackBasedVirtualMachine/vm"
+)
+
+// Instruction is one decoded instruction, it spans Words ROM words
+type Instruction struct {
+	Index     uint64
+	Word      uint64
+	Opcode    uint8
+	Operand   uint64 // The immediate word for wide instructions such as PUSH64
+	Name      string // Empty when the opcode is unknown
+	Words     int
+	Truncated bool   // A wide instruction whose immediate is missing
+	Target    uint64 // Destination of a CALL or of a PUSH feeding a jump
+	HasTarget bool
+}
+
+// Known reports whether the opcode belongs to the instruction set
+func (ins Instruction) Known() bool {
+	return ins.Name != ""
+}
+
+// Disassemble decodes every instruction of code, unknown opcodes are kept
+// and reported through Instruction.Known rather than ending the listing
+func Disassemble(code []uint64) []Instruction {
+	instructions := make([]Instruction, 0, len(code))
+	for i := 0; i < len(code); {
+		opcode, operand := vm.Decode(code[i])
+		ins := Instruction{Index: uint64(i), Word: code[i], Opcode: opcode, Operand: operand, Words: 1}
+		if info, ok := vm.LookupOpcode(opcode); ok {
+			ins.Name = info.Name
+			if info.Wide && i+1 < len(code) {
+				ins.Operand, ins.Words = code[i+1], 2
+			} else if info.Wide {
+				ins.Truncated = true
+			}
+		}
+		instructions = append(instructions, ins)
+		i += ins.Words
+	}
+	for i := range instructions {
+		ins := &instructions[i]
+		switch {
+		case ins.Opcode == vm.CALL && ins.Known():
+			ins.Target, ins.HasTarget = ins.Operand, true
+		case (ins.Opcode == vm.PUSH || ins.Opcode == vm.PUSH64) && !ins.Truncated && i+1 < len(instructions):
+			if info, ok := vm.LookupOpcode(instructions[i+1].Opcode); ok && info.Jump {
+				ins.Target, ins.HasTarget = ins.Operand, true
+			}
+		}
+	}
+	return instructions
+}
+
+// Fprint writes code as assembly that Assemble accepts again. Jump and call
+// targets are printed as labels, taken from labels when given and named
+// after the instruction index otherwise. Unknown opcodes are written as
+// .word and flagged in a comment.
+func Fprint(w io.Writer, code []uint64, labels map[string]uint64) error {
+	instructions := Disassemble(code)
+	names := make(map[uint64][]string)
+	for name, index := range labels {
+		names[index] = append(names[index], name)
+	}
+	for _, list := range names {
+		sort.Strings(list)
+	}
+	starts := make(map[uint64]bool)
+	for _, ins := range instructions {
+		starts[ins.Index] = true
+	}
+	for _, ins := range instructions {
+		if ins.HasTarget && starts[ins.Target] && len(names[ins.Target]) == 0 {
+			names[ins.Target] = []string{fmt.Sprintf("L%04d", ins.Target)}
+		}
+	}
+
+	for _, ins := range instructions {
+		for _, name := range names[ins.Index] {
+			if _, err := fmt.Fprintf(w, "%s:\n", name); err != nil {
+				return err
+			}
+		}
+		text, comment := formatInstruction(ins, names, starts)
+		if _, err := fmt.Fprintf(w, "\t%-24s ; %04d%s\n", text, ins.Index, comment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatInstruction(ins Instruction, names map[uint64][]string, starts map[uint64]bool) (string, string) {
+	if !ins.Known() {
+		return fmt.Sprintf(".word 0x%016x", ins.Word), fmt.Sprintf(" unknown opcode 0x%02x", ins.Opcode)
+	}
+	if ins.Truncated {
+		return fmt.Sprintf(".word 0x%016x", ins.Word), fmt.Sprintf(" %s without its immediate", ins.Name)
+	}
+	info, _ := vm.LookupOpcode(ins.Opcode)
+	if info.Wide && ins.Word&vm.MaxOperand != 0 {
+		return fmt.Sprintf(".word 0x%016x\n\t.word 0x%016x", ins.Word, ins.Operand), fmt.Sprintf(" %s with operand bits set", ins.Name)
+	}
+	if !info.Operand && !info.Wide {
+		if ins.Operand != 0 {
+			return fmt.Sprintf(".word 0x%016x", ins.Word), fmt.Sprintf(" %s with operand %d", ins.Name, ins.Operand)
+		}
+		return ins.Name, ""
+	}
+	if ins.Opcode == vm.PUSHF {
+		value := math.Float64frombits(ins.Operand << 8)
+		if math.IsNaN(value) && ins.Operand<<8 != quietNaN {
+			return fmt.Sprintf(".word 0x%016x", ins.Word), " PUSHF with NaN payload"
+		}
+		return fmt.Sprintf("%s %s", ins.Name, strconv.FormatFloat(value, 'g', -1, 64)), ""
+	}
+	if ins.HasTarget {
+		if !starts[ins.Target] {
+			return fmt.Sprintf("%s %d", ins.Name, ins.Operand), " -> not an instruction"
+		}
+		return fmt.Sprintf("%s %s", ins.Name, names[ins.Target][0]), ""
+	}
+	if info.Wide {
+		return fmt.Sprintf("%s 0x%x", ins.Name, ins.Operand), ""
+	}
+	return fmt.Sprintf("%s %d", ins.Name, ins.Operand), ""
+}
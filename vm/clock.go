@@ -0,0 +1,93 @@
+package vm
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Clock tells the time to the TIME instruction
+type Clock interface {
+	// Now returns the time once steps instructions have been executed
+	Now(steps uint64) time.Time
+}
+
+// RealClock is the wall clock of the host
+type RealClock struct{}
+
+func (RealClock) Now(uint64) time.Time {
+	return time.Now()
+}
+
+// FixedClock always returns Time
+type FixedClock struct {
+	Time time.Time
+}
+
+func (clock FixedClock) Now(uint64) time.Time {
+	return clock.Time
+}
+
+// VirtualClock starts at Start and advances by Tick with every instruction
+type VirtualClock struct {
+	Start time.Time
+	Tick  time.Duration
+}
+
+func (clock VirtualClock) Now(steps uint64) time.Time {
+	return clock.Start.Add(time.Duration(steps) * clock.Tick)
+}
+
+// DeterministicClock is the clock of a VM in deterministic mode, every
+// instruction takes a millisecond from the Unix epoch
+var DeterministicClock = VirtualClock{Start: time.Unix(0, 0).UTC(), Tick: time.Millisecond}
+
+// DeterministicSeed seeds the random numbers of a VM in deterministic mode
+const DeterministicSeed uint64 = 0x5eed
+
+// SetClock replaces the clock of TIME, nil restores the default one
+func (vm *VM) SetClock(clock Clock) {
+	if clock == nil {
+		clock = RealClock{}
+		if vm.config.Deterministic {
+			clock = DeterministicClock
+		}
+	}
+	vm.clock = clock
+}
+
+// Rand returns the random numbers of the VM. Host services should draw from
+// it rather than from math/rand so that deterministic runs are reproducible.
+func (cpu *CPU) Rand() *rand.Rand {
+	return cpu.vm.rand
+}
+
+// seedRandom seeds the random numbers from the clock, or with
+// DeterministicSeed in deterministic mode
+func (vm *VM) seedRandom() {
+	seed := uint64(time.Now().UnixNano())
+	if vm.config.Deterministic {
+		seed = DeterministicSeed
+	}
+	vm.random = splitMix(seed)
+	vm.rand = rand.New(&vm.random)
+}
+
+// splitMix is the SplitMix64 generator, its whole state is one word so that
+// snapshots can save it
+type splitMix uint64
+
+func (s *splitMix) Uint64() uint64 {
+	*s += 0x9e3779b97f4a7c15
+	z := uint64(*s)
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (s *splitMix) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+func (s *splitMix) Seed(seed int64) {
+	*s = splitMix(seed)
+}
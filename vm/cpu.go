@@ -1,432 +1,1152 @@
 package vm
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"math"
 	"time"
 )
 
 type CPU struct {
-	vm    *VM
-	stack *Stack
-	ip    uint64
-	hlt   bool
+	vm       *VM
+	stack    *Stack
+	ip       uint64
+	hlt      bool
+	gas      gasMeter
+	at       uint64      // IP of the instruction being executed
+	steps    uint64      // Number of instructions executed
+	paused   *WatchEvent // Set by a watchpoint that stops the program
+	tracer   *Tracer
+	record   *TraceRecord // Trace of the instruction being executed
+	profiler *Profiler
 }
 
+// MakeCPU makes a CPU for vm with the stack described by its config
 func MakeCPU(vm *VM) *CPU {
-	cpu := CPU{vm: vm, stack: MakeStack(), ip: 0}
+	stack := makeStack(vm.config.StackDepth, vm.config.GrowableStack, vm.config.CallDepth)
+	cpu := CPU{vm: vm, stack: stack, ip: 0, gas: gasMeter{table: DefaultGasTable()}}
 	return &cpu
 }
 
-func (cpu *CPU) Run() {
+// cancelCheckInterval is the number of instructions executed between two
+// checks of the context passed to RunContext
+const cancelCheckInterval = 1024
+
+// Run executes instructions until HLT or a fault, faults are returned as *Fault
+func (cpu *CPU) Run() error {
+	return cpu.RunContext(context.Background())
+}
+
+// RunContext is Run that also stops when ctx is done and returns ctx.Err().
+// The CPU is not halted then, calling RunContext again resumes the program.
+func (cpu *CPU) RunContext(ctx context.Context) error {
 	idleTime := 0
-	for !cpu.hlt {
-		instruction := cpu.fetch()
-		opcode, operand := cpu.decode(instruction)
-		cpu.exec(opcode, operand)
+	done := ctx.Done()
+	for n := 0; !cpu.hlt; n++ {
+		if done != nil && n%cancelCheckInterval == 0 {
+			select {
+			case <-done:
+				return ctx.Err()
+			default:
+			}
+		}
+		if err := cpu.step(); err != nil {
+			return err
+		}
 		if idleTime > 0 {
 			time.Sleep(time.Millisecond * time.Duration(idleTime))
 		}
 	}
+	return nil
+}
+
+func (cpu *CPU) step() error {
+	ip := cpu.ip
+	cpu.at = ip
+	if cpu.tracer != nil {
+		cpu.tracer.begin(cpu, ip)
+	}
+	err := cpu.execute(ip)
+	cpu.steps++
+	if cpu.record != nil {
+		cpu.tracer.end(cpu, err)
+	}
+	if err != nil {
+		return err
+	}
+	if event := cpu.paused; event != nil {
+		cpu.paused = nil
+		return event
+	}
+	return nil
+}
+
+func (cpu *CPU) execute(ip uint64) error {
+	instruction, err := cpu.fetch()
+	if err != nil {
+		return cpu.fault(err, ip, 0)
+	}
+	opcode, operand := cpu.decode(instruction)
+	if err := cpu.gas.charge(opcode); err != nil {
+		cpu.ip = ip
+		return cpu.fault(err, ip, opcode)
+	}
+	if err := cpu.exec(opcode, operand); err != nil {
+		return cpu.fault(err, ip, opcode)
+	}
+	if cpu.profiler != nil {
+		cpu.profiler.count(ip, opcode, operand, cpu.gas.table[opcode])
+	}
+	return nil
+}
+
+// fault halts the CPU and records where err happened when it is a *Fault
+func (cpu *CPU) fault(err error, ip uint64, opcode uint8) error {
+	cpu.hlt = true
+	var fault *Fault
+	if errors.As(err, &fault) {
+		fault.IP = ip
+		fault.Opcode = opcode
+		fault.Depth = cpu.stack.index
+		fault.Gas = cpu.gas.used
+	}
+	return err
 }
 
-func (cpu *CPU) fetch() uint64 {
+func (cpu *CPU) fetch() (uint64, error) {
+	if cpu.ip >= uint64(len(cpu.vm.memory)/8) {
+		return 0, &Fault{Kind: MemoryOutOfBounds, Addr: cpu.ip * 8}
+	}
+	if err := cpu.vm.checkAccess(cpu.ip*8, 8, PermExecute); err != nil {
+		return 0, err
+	}
 	instruction := cpu.vm.LoadInstruction(cpu.ip)
 	cpu.ip += 1
-	return instruction
+	return instruction, nil
 }
 
 func (cpu *CPU) decode(instruction uint64) (uint8, uint64) {
-	opcode := uint8(instruction >> 56)
-	operand := instruction << 8
-	operand = operand >> 8
-	return opcode, operand
+	return Decode(instruction)
 }
 
-func (cpu *CPU) exec(opcode uint8, operand uint64) {
+func (cpu *CPU) exec(opcode uint8, operand uint64) error {
 	// fmt.Println("Exec instruction", opcode, operand)
 	switch opcode {
 	case PUSH:
-		cpu.processPush(operand)
+		return cpu.processPush(operand)
+	case PUSH64:
+		return cpu.processPush64()
+	case PUSHF:
+		return cpu.processPush(operand << 8)
 	case POP:
-		cpu.processPop()
+		return cpu.processPop()
 	case ADD:
-		cpu.processAdd()
+		return cpu.processAdd()
 	case SUB:
-		cpu.processSub()
+		return cpu.processSub()
 	case MUL:
-		cpu.processMul()
+		return cpu.processMul()
 	case DIV:
-		cpu.processDiv()
+		return cpu.processDiv()
 	case MOD:
-		cpu.processMod()
+		return cpu.processMod()
+	case POW:
+		return cpu.processPow()
+	case IMUL:
+		return cpu.processIMul()
+	case IDIV:
+		return cpu.processIDiv()
+	case SMOD:
+		return cpu.processSMod()
+	case NEG:
+		return cpu.processNEG()
+	case ABS:
+		return cpu.processABS()
+	case SEXT8:
+		return cpu.processSEXT(8)
+	case SEXT16:
+		return cpu.processSEXT(16)
+	case SEXT32:
+		return cpu.processSEXT(32)
 	case AND:
-		cpu.processAnd()
+		return cpu.processAnd()
 	case OR:
-		cpu.processOr()
+		return cpu.processOr()
 	case XOR:
-		cpu.processXor()
+		return cpu.processXor()
+	case NAND:
+		return cpu.processNand()
 	case NOT:
-		cpu.processNot()
+		return cpu.processNot()
 	case INC:
-		cpu.processINC()
+		return cpu.processINC()
 	case DEC:
-		cpu.processDEC()
+		return cpu.processDEC()
 	case SHL:
-		cpu.processSHL()
+		return cpu.processSHL()
 	case SHR:
-		cpu.processSHR()
+		return cpu.processSHR()
+	case SAR:
+		return cpu.processSAR()
 	case DUP:
-		cpu.processDup()
+		return cpu.processDup()
 	case SWAP:
-		cpu.processSwap()
+		return cpu.processSwap()
 	case EQ:
-		cpu.processEQ()
+		return cpu.processEQ()
 	case LT:
-		cpu.processLT()
+		return cpu.processLT()
 	case GT:
-		cpu.processGT()
+		return cpu.processGT()
 	case LTE:
-		cpu.processLTE()
+		return cpu.processLTE()
 	case GTE:
-		cpu.processGTE()
+		return cpu.processGTE()
+	case SLT:
+		return cpu.processSLT()
+	case SGT:
+		return cpu.processSGT()
+	case SLE:
+		return cpu.processSLE()
+	case SGE:
+		return cpu.processSGE()
 	case LOAD:
-		cpu.processLOAD()
+		return cpu.processLOAD()
 	case STORE:
-		cpu.processSTORE()
+		return cpu.processSTORE()
 	case LOAD8:
-		cpu.processLOAD8()
+		return cpu.processLOAD8()
 	case STORE8:
-		cpu.processSTORE8()
+		return cpu.processSTORE8()
+	case FADD:
+		return cpu.processFloat(func(a, b float64) float64 { return a + b })
+	case FSUB:
+		return cpu.processFloat(func(a, b float64) float64 { return a - b })
+	case FMUL:
+		return cpu.processFloat(func(a, b float64) float64 { return a * b })
+	case FDIV:
+		return cpu.processFloat(func(a, b float64) float64 { return a / b })
+	case FNEG:
+		return cpu.processFNEG()
+	case FSQRT:
+		return cpu.processFSQRT()
+	case FEQ:
+		return cpu.processFCompare(func(a, b float64) bool { return a == b })
+	case FLT:
+		return cpu.processFCompare(func(a, b float64) bool { return a < b })
+	case FLE:
+		return cpu.processFCompare(func(a, b float64) bool { return a <= b })
+	case FGT:
+		return cpu.processFCompare(func(a, b float64) bool { return a > b })
+	case FGE:
+		return cpu.processFCompare(func(a, b float64) bool { return a >= b })
+	case FCMP:
+		return cpu.processFCMP()
+	case I2F:
+		return cpu.processI2F()
+	case U2F:
+		return cpu.processU2F()
+	case F2I:
+		return cpu.processF2I()
+	case SLOAD:
+		return cpu.processSLOAD()
+	case SSTORE:
+		return cpu.processSSTORE()
+	case SLOAD8:
+		return cpu.processSLOAD8()
+	case SSTORE8:
+		return cpu.processSSTORE8()
 	case JMP:
-		cpu.processJmp()
+		return cpu.processJmp()
 	case JN:
-		cpu.processJN()
+		return cpu.processJN()
 	case JP:
-		cpu.processJP()
+		return cpu.processJP()
 	case JZ:
-		cpu.processJZ()
+		return cpu.processJZ()
 	case JNZ:
-		cpu.processJNZ()
+		return cpu.processJNZ()
 	case JE:
-		cpu.processJE()
+		return cpu.processJE()
 	case JNE:
-		cpu.processJNE()
+		return cpu.processJNE()
 	case JLT:
-		cpu.processJLT()
+		return cpu.processJLT()
 	case JGT:
-		cpu.processJGT()
+		return cpu.processJGT()
 	case JLE:
-		cpu.processJLE()
+		return cpu.processJLE()
 	case JGE:
-		cpu.processJGE()
+		return cpu.processJGE()
+	case JSLT:
+		return cpu.processJSLT()
+	case JSGT:
+		return cpu.processJSGT()
+	case JSLE:
+		return cpu.processJSLE()
+	case JSGE:
+		return cpu.processJSGE()
 	case TIME:
-		cpu.processTIME()
+		return cpu.processTIME()
 	case CALL:
-		cpu.processCALL(operand)
+		return cpu.processCALL(operand)
 	case RET:
-		cpu.processRET()
+		return cpu.processRET()
 	case HLT:
-		cpu.processHLT()
+		return cpu.processHLT()
 	case SPACE:
-		cpu.processSPACE()
+		return cpu.processSPACE()
+	case SYSCALL:
+		return cpu.processSYSCALL(operand)
+	case ALLOC:
+		return cpu.processALLOC()
+	case FREE:
+		return cpu.processFREE()
+	case REALLOC:
+		return cpu.processREALLOC()
 	default:
-		cpu.stop()
+		// Memory past the loaded rom is zeroed, running into it halts as it
+		// always has. Opcode 0 inside the rom and other unknown opcodes fault.
+		if opcode == 0 && cpu.at >= uint64(len(cpu.vm.rom)) {
+			return cpu.processHLT()
+		}
+		return &Fault{Kind: InvalidOpcode}
+	}
+}
+
+func (cpu *CPU) processPush(value uint64) error {
+	return cpu.stack.Push(value)
+}
+
+// processPush64 consumes the next ROM word as the value to push
+func (cpu *CPU) processPush64() error {
+	value, err := cpu.fetch()
+	if err != nil {
+		return err
+	}
+	return cpu.stack.Push(value)
+}
+
+func (cpu *CPU) processPop() error {
+	_, err := cpu.stack.Pop()
+	return err
+}
+
+// popPair pops the two topmost values, b is the one that was on top
+func (cpu *CPU) popPair() (uint64, uint64, error) {
+	b, err := cpu.stack.Pop()
+	if err != nil {
+		return 0, 0, err
+	}
+	a, err := cpu.stack.Pop()
+	if err != nil {
+		return 0, 0, err
+	}
+	return a, b, nil
+}
+
+func (cpu *CPU) processAdd() error {
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	return cpu.stack.Push(a + b)
+}
+
+func (cpu *CPU) processSub() error {
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	return cpu.stack.Push(a - b)
+}
+
+func (cpu *CPU) processMul() error {
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	return cpu.stack.Push(a * b)
+}
+
+func (cpu *CPU) processDiv() error {
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return &Fault{Kind: DivisionByZero}
+	}
+	return cpu.stack.Push(a / b)
+}
+
+func (cpu *CPU) processMod() error {
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return &Fault{Kind: DivisionByZero}
+	}
+	return cpu.stack.Push(a % b)
+}
+
+// processPow raises stack[i-1] to the power stack[i], wrapping around on overflow
+func (cpu *CPU) processPow() error {
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	var r uint64 = 1
+	for ; b > 0; b >>= 1 {
+		if b&1 == 1 {
+			r *= a
+		}
+		a *= a
 	}
+	return cpu.stack.Push(r)
 }
 
-func (cpu *CPU) processPush(value uint64) {
-	cpu.stack.Push(value)
+func (cpu *CPU) processIMul() error {
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	return cpu.stack.Push(uint64(int64(a) * int64(b)))
 }
 
-func (cpu *CPU) processPop() {
-	cpu.stack.Pop()
+// processIDiv divides two's complement values, truncating toward zero
+func (cpu *CPU) processIDiv() error {
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return &Fault{Kind: DivisionByZero}
+	}
+	return cpu.stack.Push(uint64(int64(a) / int64(b)))
+}
+
+// processSMod computes the signed remainder, it has the sign of the dividend
+func (cpu *CPU) processSMod() error {
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return &Fault{Kind: DivisionByZero}
+	}
+	return cpu.stack.Push(uint64(int64(a) % int64(b)))
 }
 
-func (cpu *CPU) processAdd() {
-	b := cpu.stack.Pop()
-	a := cpu.stack.Pop()
-	cpu.stack.Push(a + b)
+func (cpu *CPU) processNEG() error {
+	a, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
+	return cpu.stack.Push(uint64(-int64(a)))
 }
 
-func (cpu *CPU) processSub() {
-	b := cpu.stack.Pop()
-	a := cpu.stack.Pop()
-	cpu.stack.Push(a - b)
+// processABS leaves the most negative number unchanged as it has no positive counterpart
+func (cpu *CPU) processABS() error {
+	a, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
+	if int64(a) < 0 {
+		a = uint64(-int64(a))
+	}
+	return cpu.stack.Push(a)
 }
 
-func (cpu *CPU) processMul() {
-	b := cpu.stack.Pop()
-	a := cpu.stack.Pop()
-	cpu.stack.Push(a * b)
+// processSEXT sign extends the low bits of stack[i] to 64 bits
+func (cpu *CPU) processSEXT(bits uint64) error {
+	a, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
+	return cpu.stack.Push(uint64(int64(a<<(64-bits)) >> (64 - bits)))
 }
 
-func (cpu *CPU) processDiv() {
-	b := cpu.stack.Pop()
-	a := cpu.stack.Pop()
-	cpu.stack.Push(a / b)
+func (cpu *CPU) processAnd() error {
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	return cpu.stack.Push(a & b)
 }
 
-func (cpu *CPU) processMod() {
-	b := cpu.stack.Pop()
-	a := cpu.stack.Pop()
-	cpu.stack.Push(a % b)
+func (cpu *CPU) processOr() error {
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	return cpu.stack.Push(a | b)
 }
 
-func (cpu *CPU) processAnd() {
-	b := cpu.stack.Pop()
-	a := cpu.stack.Pop()
-	cpu.stack.Push(a & b)
+func (cpu *CPU) processXor() error {
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	return cpu.stack.Push(a ^ b)
 }
 
-func (cpu *CPU) processOr() {
-	b := cpu.stack.Pop()
-	a := cpu.stack.Pop()
-	cpu.stack.Push(a | b)
+func (cpu *CPU) processNand() error {
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	return cpu.stack.Push(^(a & b))
 }
 
-func (cpu *CPU) processXor() {
-	b := cpu.stack.Pop()
-	a := cpu.stack.Pop()
-	cpu.stack.Push(a ^ b)
+func (cpu *CPU) processNot() error {
+	a, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
+	return cpu.stack.Push(math.MaxUint64 ^ a)
 }
 
-func (cpu *CPU) processNot() {
-	a := cpu.stack.Pop()
-	cpu.stack.Push(math.MaxUint64 ^ a)
+func (cpu *CPU) processINC() error {
+	a, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
+	return cpu.stack.Push(a + 1)
 }
 
-func (cpu *CPU) processINC() {
-	a := cpu.stack.Pop()
-	cpu.stack.Push(a + 1)
+func (cpu *CPU) processDEC() error {
+	a, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
+	return cpu.stack.Push(a - 1)
 }
 
-func (cpu *CPU) processDEC() {
-	a := cpu.stack.Pop()
-	cpu.stack.Push(a - 1)
+func (cpu *CPU) processSHL() error {
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	return cpu.stack.Push(a << b)
 }
 
-func (cpu *CPU) processSHL() {
-	b := cpu.stack.Pop()
-	a := cpu.stack.Pop()
-	cpu.stack.Push(a << b)
+func (cpu *CPU) processSHR() error {
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	return cpu.stack.Push(a >> b)
 }
 
-func (cpu *CPU) processSHR() {
-	b := cpu.stack.Pop()
-	a := cpu.stack.Pop()
-	cpu.stack.Push(a >> b)
+func (cpu *CPU) processSAR() error {
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	return cpu.stack.Push(uint64(int64(a) >> b))
 }
 
-func (cpu *CPU) processDup() {
-	a := cpu.stack.Top()
-	cpu.stack.Push(a)
+func (cpu *CPU) processDup() error {
+	a, err := cpu.stack.Top()
+	if err != nil {
+		return err
+	}
+	return cpu.stack.Push(a)
 }
 
-func (cpu *CPU) processSwap() {
-	b := cpu.stack.Pop()
-	a := cpu.stack.Pop()
+func (cpu *CPU) processSwap() error {
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
 	cpu.stack.Push(b)
-	cpu.stack.Push(a)
+	return cpu.stack.Push(a)
 }
 
-func (cpu *CPU) processEQ() {
-	b := cpu.stack.Pop()
-	a := cpu.stack.Pop()
+func (cpu *CPU) processEQ() error {
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
 	var r uint64 = 0
 	if a == b {
 		r = 1
 	}
-	cpu.stack.Push(r)
+	return cpu.stack.Push(r)
 }
 
-func (cpu *CPU) processLT() {
-	b := cpu.stack.Pop()
-	a := cpu.stack.Pop()
+func (cpu *CPU) processLT() error {
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
 	var r uint64 = 0
 	if a < b {
 		r = 1
 	}
-	cpu.stack.Push(r)
+	return cpu.stack.Push(r)
 }
 
-func (cpu *CPU) processGT() {
-	b := cpu.stack.Pop()
-	a := cpu.stack.Pop()
+func (cpu *CPU) processGT() error {
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
 	var r uint64 = 0
 	if a > b {
 		r = 1
 	}
-	cpu.stack.Push(r)
+	return cpu.stack.Push(r)
 }
 
-func (cpu *CPU) processLTE() {
-	b := cpu.stack.Pop()
-	a := cpu.stack.Pop()
+func (cpu *CPU) processLTE() error {
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
 	var r uint64 = 0
 	if a <= b {
 		r = 1
 	}
-	cpu.stack.Push(r)
+	return cpu.stack.Push(r)
 }
 
-func (cpu *CPU) processGTE() {
-	b := cpu.stack.Pop()
-	a := cpu.stack.Pop()
+func (cpu *CPU) processGTE() error {
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
 	var r uint64 = 0
 	if a >= b {
 		r = 1
 	}
-	cpu.stack.Push(r)
+	return cpu.stack.Push(r)
+}
+
+func (cpu *CPU) processSLT() error {
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	var r uint64 = 0
+	if int64(a) < int64(b) {
+		r = 1
+	}
+	return cpu.stack.Push(r)
+}
+
+func (cpu *CPU) processSGT() error {
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	var r uint64 = 0
+	if int64(a) > int64(b) {
+		r = 1
+	}
+	return cpu.stack.Push(r)
+}
+
+func (cpu *CPU) processSLE() error {
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	var r uint64 = 0
+	if int64(a) <= int64(b) {
+		r = 1
+	}
+	return cpu.stack.Push(r)
+}
+
+func (cpu *CPU) processSGE() error {
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	var r uint64 = 0
+	if int64(a) >= int64(b) {
+		r = 1
+	}
+	return cpu.stack.Push(r)
+}
+
+// popFloatPair pops the two topmost values as float64, b is the one that was on top
+func (cpu *CPU) popFloatPair() (float64, float64, error) {
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return 0, 0, err
+	}
+	return math.Float64frombits(a), math.Float64frombits(b), nil
+}
+
+func (cpu *CPU) processFloat(op func(a, b float64) float64) error {
+	a, b, err := cpu.popFloatPair()
+	if err != nil {
+		return err
+	}
+	return cpu.stack.Push(math.Float64bits(op(a, b)))
+}
+
+func (cpu *CPU) processFCompare(cond func(a, b float64) bool) error {
+	a, b, err := cpu.popFloatPair()
+	if err != nil {
+		return err
+	}
+	var r uint64 = 0
+	if cond(a, b) {
+		r = 1
+	}
+	return cpu.stack.Push(r)
+}
+
+func (cpu *CPU) processFCMP() error {
+	a, b, err := cpu.popFloatPair()
+	if err != nil {
+		return err
+	}
+	var r int64 = 2
+	switch {
+	case a < b:
+		r = -1
+	case a == b:
+		r = 0
+	case a > b:
+		r = 1
+	}
+	return cpu.stack.Push(uint64(r))
+}
+
+func (cpu *CPU) processFNEG() error {
+	a, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
+	return cpu.stack.Push(a ^ 1<<63)
+}
+
+func (cpu *CPU) processFSQRT() error {
+	a, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
+	return cpu.stack.Push(math.Float64bits(math.Sqrt(math.Float64frombits(a))))
+}
+
+func (cpu *CPU) processI2F() error {
+	a, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
+	return cpu.stack.Push(math.Float64bits(float64(int64(a))))
+}
+
+func (cpu *CPU) processU2F() error {
+	a, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
+	return cpu.stack.Push(math.Float64bits(float64(a)))
+}
+
+// processF2I saturates because Go leaves out of range conversions undefined
+func (cpu *CPU) processF2I() error {
+	a, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
+	f := math.Float64frombits(a)
+	var r int64
+	switch {
+	case math.IsNaN(f):
+		r = 0
+	case f >= math.MaxInt64:
+		r = math.MaxInt64
+	case f <= math.MinInt64:
+		r = math.MinInt64
+	default:
+		r = int64(f)
+	}
+	return cpu.stack.Push(uint64(r))
+}
+
+// observed reports whether memory accesses go to watchpoints or the tracer
+func (cpu *CPU) observed() bool {
+	return len(cpu.vm.watchpoints) > 0 || cpu.record != nil
+}
+
+func (cpu *CPU) access(kind WatchKind, offset uint64, size uint64, old uint64, new uint64) {
+	cpu.watch(kind, offset, size, old, new)
+	if cpu.record != nil {
+		cpu.record.Memory = append(cpu.record.Memory, MemoryEffect{Access: kind.String(), Offset: offset, Size: size, Value: new})
+	}
+}
+
+// dataAddress translates an offset in the data segment to a memory index
+// and checks that size bytes from there can be accessed with perm. Offsets
+// wrap around, so large ones reach the segments below the data segment.
+func (cpu *CPU) dataAddress(offset uint64, size uint64, perm Permission) (uint64, error) {
+	index := offset + uint64(cpu.vm.getDataSegment())
+	if err := cpu.vm.checkAccess(index, size, perm); err != nil {
+		return 0, err
+	}
+	return index, nil
 }
 
-func (cpu *CPU) processLOAD() {
-	index := cpu.stack.Pop() + uint64(cpu.vm.getDataSegment())
+func (cpu *CPU) processLOAD() error {
+	offset, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
+	index, err := cpu.heapAddress(offset, 8, PermRead)
+	if err != nil {
+		return err
+	}
 	bytes := cpu.vm.memory[index : index+8]
 	num := binary.LittleEndian.Uint64(bytes)
-	cpu.stack.Push(num)
+	if cpu.observed() {
+		cpu.access(WatchRead, offset, 8, num, num)
+	}
+	return cpu.stack.Push(num)
 }
 
-func (cpu *CPU) processSTORE() {
-	index := cpu.stack.Pop() + uint64(cpu.vm.getDataSegment())
-	value := cpu.stack.Pop()
+func (cpu *CPU) processSTORE() error {
+	value, offset, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	index, err := cpu.heapAddress(offset, 8, PermWrite)
+	if err != nil {
+		return err
+	}
+	if cpu.observed() {
+		old := binary.LittleEndian.Uint64(cpu.vm.memory[index : index+8])
+		cpu.access(WatchWrite, offset, 8, old, value)
+	}
 	binary.LittleEndian.PutUint64(cpu.vm.memory[index:index+8], value)
+	return nil
 }
 
-func (cpu *CPU) processLOAD8() {
-	index := cpu.stack.Pop() + uint64(cpu.vm.getDataSegment())
+func (cpu *CPU) processLOAD8() error {
+	offset, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
+	index, err := cpu.heapAddress(offset, 1, PermRead)
+	if err != nil {
+		return err
+	}
 	num := uint64(cpu.vm.memory[index])
-	cpu.stack.Push(num)
+	if cpu.observed() {
+		cpu.access(WatchRead, offset, 1, num, num)
+	}
+	return cpu.stack.Push(num)
 }
 
-func (cpu *CPU) processSTORE8() {
-	index := cpu.stack.Pop() + uint64(cpu.vm.getDataSegment())
-	value := cpu.stack.Pop()
+func (cpu *CPU) processSTORE8() error {
+	value, offset, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	index, err := cpu.heapAddress(offset, 1, PermWrite)
+	if err != nil {
+		return err
+	}
+	if cpu.observed() {
+		cpu.access(WatchWrite, offset, 1, uint64(cpu.vm.memory[index]), value&0xff)
+	}
 	cpu.vm.memory[index] = uint8(value & 0x00000000000000ff)
+	return nil
+}
+
+func (cpu *CPU) processSLOAD() error {
+	slot, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
+	num, err := cpu.stack.Load(slot)
+	if err != nil {
+		return err
+	}
+	return cpu.stack.Push(num)
+}
+
+func (cpu *CPU) processSSTORE() error {
+	value, slot, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	return cpu.stack.Store(slot, value)
+}
+
+// processSLOAD8 addresses the frame bytewise, slots are little endian like memory
+func (cpu *CPU) processSLOAD8() error {
+	offset, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
+	num, err := cpu.stack.Load(offset / 8)
+	if err != nil {
+		return err
+	}
+	return cpu.stack.Push((num >> (offset % 8 * 8)) & 0xff)
+}
+
+func (cpu *CPU) processSSTORE8() error {
+	value, offset, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	num, err := cpu.stack.Load(offset / 8)
+	if err != nil {
+		return err
+	}
+	shift := offset % 8 * 8
+	num = num&^(0xff<<shift) | (value&0xff)<<shift
+	return cpu.stack.Store(offset/8, num)
 }
 
-func (cpu *CPU) processJmp() {
-	ip := cpu.stack.Pop()
+func (cpu *CPU) processJmp() error {
+	ip, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
 	cpu.setPC(ip)
+	return nil
 }
 
-func (cpu *CPU) processJN() {
-	ip := cpu.stack.Pop()
-	a := cpu.stack.Pop()
+func (cpu *CPU) processJN() error {
+	a, ip, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
 	b := ((a << 1) >> 1)
 	a = a >> 63
 	if a == 1 && b > 0 {
 		cpu.setPC(ip)
 	}
+	return nil
 }
 
-func (cpu *CPU) processJP() {
-	ip := cpu.stack.Pop()
-	a := cpu.stack.Pop()
+func (cpu *CPU) processJP() error {
+	a, ip, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
 	b := ((a << 1) >> 1)
 	a = a >> 63
 	if a == 0 && b > 0 {
 		cpu.setPC(ip)
 	}
+	return nil
 }
 
-func (cpu *CPU) processJZ() {
-	ip := cpu.stack.Pop()
-	a := cpu.stack.Pop()
+func (cpu *CPU) processJZ() error {
+	a, ip, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
 	if a == 0 {
 		cpu.setPC(ip)
 	}
+	return nil
 }
 
-func (cpu *CPU) processJNZ() {
-	ip := cpu.stack.Pop()
-	a := cpu.stack.Pop()
+func (cpu *CPU) processJNZ() error {
+	a, ip, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
 	if a != 0 {
 		cpu.setPC(ip)
 	}
+	return nil
 }
 
-func (cpu *CPU) processJE() {
-	ip := cpu.stack.Pop()
-	b := cpu.stack.Pop()
-	a := cpu.stack.Pop()
+func (cpu *CPU) processJE() error {
+	ip, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
 	if a == b {
 		cpu.setPC(ip)
 	}
+	return nil
 }
 
-func (cpu *CPU) processJNE() {
-	ip := cpu.stack.Pop()
-	b := cpu.stack.Pop()
-	a := cpu.stack.Pop()
+func (cpu *CPU) processJNE() error {
+	ip, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
 	if a != b {
 		cpu.setPC(ip)
 	}
+	return nil
 }
 
-func (cpu *CPU) processJLT() {
-	ip := cpu.stack.Pop()
-	b := cpu.stack.Pop()
-	a := cpu.stack.Pop()
+func (cpu *CPU) processJLT() error {
+	ip, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
 	if a < b {
 		cpu.setPC(ip)
 	}
+	return nil
 }
 
-func (cpu *CPU) processJGT() {
-	ip := cpu.stack.Pop()
-	b := cpu.stack.Pop()
-	a := cpu.stack.Pop()
+func (cpu *CPU) processJGT() error {
+	ip, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
 	if a > b {
 		cpu.setPC(ip)
 	}
+	return nil
 }
 
-func (cpu *CPU) processJLE() {
-	ip := cpu.stack.Pop()
-	b := cpu.stack.Pop()
-	a := cpu.stack.Pop()
+func (cpu *CPU) processJLE() error {
+	ip, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
 	if a <= b {
 		cpu.setPC(ip)
 	}
+	return nil
 }
 
-func (cpu *CPU) processJGE() {
-	ip := cpu.stack.Pop()
-	b := cpu.stack.Pop()
-	a := cpu.stack.Pop()
+func (cpu *CPU) processJGE() error {
+	ip, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
 	if a >= b {
 		cpu.setPC(ip)
 	}
+	return nil
+}
+
+func (cpu *CPU) processJSLT() error {
+	ip, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	if int64(a) < int64(b) {
+		cpu.setPC(ip)
+	}
+	return nil
+}
+
+func (cpu *CPU) processJSGT() error {
+	ip, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	if int64(a) > int64(b) {
+		cpu.setPC(ip)
+	}
+	return nil
+}
+
+func (cpu *CPU) processJSLE() error {
+	ip, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	if int64(a) <= int64(b) {
+		cpu.setPC(ip)
+	}
+	return nil
+}
+
+func (cpu *CPU) processJSGE() error {
+	ip, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
+	a, b, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	if int64(a) >= int64(b) {
+		cpu.setPC(ip)
+	}
+	return nil
 }
 
-func (cpu *CPU) processTIME() {
-	time := uint64(time.Now().UnixMilli())
-	cpu.stack.Push(time)
+func (cpu *CPU) processTIME() error {
+	now := cpu.vm.clock.Now(cpu.steps)
+	return cpu.stack.Push(uint64(now.UnixMilli()))
 }
 
-func (cpu *CPU) processCALL(label uint64) {
-	cpu.stack.SetupCall(cpu.ip)
+func (cpu *CPU) processCALL(label uint64) error {
+	if err := cpu.stack.SetupCall(cpu.ip); err != nil {
+		return err
+	}
 	cpu.setPC(label)
+	return nil
 }
 
-func (cpu *CPU) processRET() {
-	pc := cpu.stack.SetupReturn()
+func (cpu *CPU) processRET() error {
+	pc, err := cpu.stack.SetupReturn()
+	if err != nil {
+		return err
+	}
 	cpu.setPC(pc)
+	return nil
 }
 
-func (cpu *CPU) processHLT() {
+func (cpu *CPU) processHLT() error {
 	cpu.hlt = true
+	return nil
 }
 
-func (cpu *CPU) processSPACE() {
-	cpu.stack.Push(uint64(cpu.vm.getDataSegment()))
+func (cpu *CPU) processSPACE() error {
+	return cpu.stack.Push(uint64(cpu.vm.getDataSegment()))
 }
 
 func (cpu *CPU) setPC(value uint64) {
 	cpu.ip = value
 }
-
-func (cpu *CPU) stop() {
-	cpu.hlt = true
-}
@@ -0,0 +1,431 @@
+// Package debug is an interactive step debugger for programs running on a vm.VM.
+package debug
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nguyenzung/StackBasedVirtualMachine/vm"
+	"github.com/nguyenzung/StackBasedVirtualMachine/vm/asm"
+)
+
+// Stop tells why a run command returned control to the user
+type Stop int
+
+const (
+	Stepped Stop = iota
+	Breakpoint
+	Halted
+	Faulted
+	Watched
+)
+
+// Debugger drives a VM one instruction at a time
+type Debugger struct {
+	vm          *vm.VM
+	out         io.Writer
+	breakpoints map[uint64]bool
+	labels      map[string]uint64
+	names       map[uint64][]string
+	code        []asm.Instruction
+}
+
+// New loads the ROM of machine and prepares to debug it from its first
+// instruction, labels are optional and used to name addresses
+func New(machine *vm.VM, labels map[string]uint64, out io.Writer) *Debugger {
+	machine.LoadRom()
+	names := make(map[uint64][]string)
+	for name, index := range labels {
+		names[index] = append(names[index], name)
+	}
+	for _, list := range names {
+		sort.Strings(list)
+	}
+	return &Debugger{
+		vm:          machine,
+		out:         out,
+		breakpoints: make(map[uint64]bool),
+		labels:      labels,
+		names:       names,
+		code:        asm.Disassemble(machine.ReadRom()),
+	}
+}
+
+// AddBreakpoint stops Continue, StepOver and StepOut before ip executes
+func (d *Debugger) AddBreakpoint(ip uint64) {
+	d.breakpoints[ip] = true
+}
+
+// RemoveBreakpoint clears a breakpoint set with AddBreakpoint
+func (d *Debugger) RemoveBreakpoint(ip uint64) {
+	delete(d.breakpoints, ip)
+}
+
+// Step executes a single instruction
+func (d *Debugger) Step() (Stop, error) {
+	if err := d.vm.Step(); err != nil {
+		var event *vm.WatchEvent
+		switch {
+		case errors.Is(err, vm.ErrHalted):
+			return Halted, nil
+		case errors.As(err, &event):
+			return Watched, event
+		}
+		return Faulted, err
+	}
+	if d.vm.State().Halted {
+		return Halted, nil
+	}
+	return Stepped, nil
+}
+
+// StepOver executes one instruction, a CALL runs until it returns
+func (d *Debugger) StepOver() (Stop, error) {
+	state := d.vm.State()
+	opcode, _ := vm.Decode(d.vm.LoadInstruction(state.IP))
+	if opcode != vm.CALL {
+		return d.Step()
+	}
+	next := state.IP + 1
+	return d.runUntil(func(s vm.State) bool {
+		return s.IP == next && s.Base == state.Base
+	})
+}
+
+// StepOut runs until the current function returns to its caller
+func (d *Debugger) StepOut() (Stop, error) {
+	base := d.vm.State().Base
+	if base == 0 {
+		return Stepped, errors.New("not inside a function")
+	}
+	return d.runUntil(func(s vm.State) bool {
+		return s.Base < base
+	})
+}
+
+// Continue runs until a breakpoint, HLT or a fault
+func (d *Debugger) Continue() (Stop, error) {
+	return d.runUntil(func(vm.State) bool {
+		return false
+	})
+}
+
+// runUntil steps at least once, then until done or a breakpoint
+func (d *Debugger) runUntil(done func(vm.State) bool) (Stop, error) {
+	for {
+		stop, err := d.Step()
+		if stop != Stepped {
+			return stop, err
+		}
+		state := d.vm.State()
+		if done(state) {
+			return Stepped, nil
+		}
+		if d.breakpoints[state.IP] {
+			return Breakpoint, nil
+		}
+	}
+}
+
+// Run reads commands from in until it is exhausted or the user quits. When in
+// is a *bufio.Reader it is read one line at a time, so that the guest can read
+// its input from the same reader between commands.
+func (d *Debugger) Run(in io.Reader) error {
+	reader, ok := in.(*bufio.Reader)
+	if !ok {
+		reader = bufio.NewReader(in)
+	}
+	d.printf("Type help for the list of commands\n")
+	d.printWhere()
+	for {
+		d.printf("(svm) ")
+		line, err := reader.ReadString('\n')
+		if line == "" && err != nil {
+			d.printf("\n")
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "q" || fields[0] == "quit" {
+			return nil
+		}
+		if err := d.command(fields[0], fields[1:]); err != nil {
+			d.printf("error: %v\n", err)
+		}
+	}
+}
+
+const help = `s, step            execute one instruction
+n, next            step over CALL
+o, out             run until the current function returns
+c, continue        run until a breakpoint, HLT or a fault
+b, break ADDR      set a breakpoint on an instruction index or label
+d, delete ADDR     remove a breakpoint
+stack              print the stack
+frame              print the current call frame
+mem OFFSET [SIZE]  dump bytes of the data segment
+watch OFFSET [SIZE] [r|w|rw]
+                   pause when the data segment bytes are accessed
+unwatch ID         remove a watchpoint
+l, list [N]        disassemble N instructions around IP
+regs               print IP, stack depth, frame base and gas
+q, quit            leave the debugger
+`
+
+func (d *Debugger) command(name string, args []string) error {
+	switch name {
+	case "s", "step":
+		return d.report(d.Step())
+	case "n", "next":
+		return d.report(d.StepOver())
+	case "o", "out":
+		return d.report(d.StepOut())
+	case "c", "continue":
+		return d.report(d.Continue())
+	case "b", "break", "d", "delete":
+		if len(args) != 1 {
+			return fmt.Errorf("%s expects an address", name)
+		}
+		ip, err := d.address(args[0])
+		if err != nil {
+			return err
+		}
+		if name == "b" || name == "break" {
+			d.AddBreakpoint(ip)
+		} else {
+			d.RemoveBreakpoint(ip)
+		}
+	case "stack":
+		d.printStack()
+	case "frame":
+		d.printFrame()
+	case "mem":
+		return d.printMemory(args)
+	case "watch":
+		return d.watch(args)
+	case "unwatch":
+		if len(args) != 1 {
+			return errors.New("unwatch expects a watchpoint id")
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid watchpoint id %s", args[0])
+		}
+		d.vm.RemoveWatchpoint(id)
+	case "l", "list":
+		n := 10
+		if len(args) > 0 {
+			value, err := strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("invalid count %s", args[0])
+			}
+			n = value
+		}
+		d.printListing(n)
+	case "regs":
+		state := d.vm.State()
+		d.printf("ip %d  depth %d  base %d  gas %d  halted %v\n", state.IP, state.Depth, state.Base, state.GasUsed, state.Halted)
+	case "help":
+		d.printf("%s", help)
+	default:
+		return fmt.Errorf("unknown command %s", name)
+	}
+	return nil
+}
+
+func (d *Debugger) report(stop Stop, err error) error {
+	switch stop {
+	case Breakpoint:
+		d.printf("breakpoint\n")
+	case Halted:
+		d.printf("halted\n")
+		return nil
+	case Faulted:
+		d.printf("fault: %v\n", err)
+		return nil
+	case Watched:
+		d.printf("%v\n", err)
+		d.printWhere()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	d.printWhere()
+	return nil
+}
+
+func (d *Debugger) address(text string) (uint64, error) {
+	if ip, ok := d.labels[text]; ok {
+		return ip, nil
+	}
+	ip, err := strconv.ParseUint(text, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unknown address %s", text)
+	}
+	return ip, nil
+}
+
+func (d *Debugger) printWhere() {
+	ip := d.vm.State().IP
+	if i := d.find(ip); i >= 0 {
+		d.printInstruction(d.code[i], ip)
+	} else {
+		d.printf("=> %04d  outside program\n", ip)
+	}
+}
+
+func (d *Debugger) printListing(n int) {
+	ip := d.vm.State().IP
+	center := d.find(ip)
+	if center < 0 {
+		d.printf("ip %d is outside the program\n", ip)
+		return
+	}
+	first := center - n/2
+	if first < 0 {
+		first = 0
+	}
+	for i := first; i < len(d.code) && i < first+n; i++ {
+		d.printInstruction(d.code[i], ip)
+	}
+}
+
+// find returns the position in d.code of the instruction at ip or -1
+func (d *Debugger) find(ip uint64) int {
+	i := sort.Search(len(d.code), func(i int) bool {
+		return d.code[i].Index >= ip
+	})
+	if i < len(d.code) && d.code[i].Index == ip {
+		return i
+	}
+	return -1
+}
+
+func (d *Debugger) printInstruction(ins asm.Instruction, ip uint64) {
+	marker := "  "
+	if ins.Index == ip {
+		marker = "=>"
+	}
+	bp := " "
+	if d.breakpoints[ins.Index] {
+		bp = "*"
+	}
+	text := ins.Name
+	if !ins.Known() {
+		text = fmt.Sprintf("??? 0x%02x", ins.Opcode)
+	} else if info, _ := vm.LookupOpcode(ins.Opcode); info.Operand || info.Wide {
+		text = fmt.Sprintf("%s %d", ins.Name, ins.Operand)
+	}
+	if ins.HasTarget {
+		text += " -> " + d.name(ins.Target)
+	}
+	for _, name := range d.names[ins.Index] {
+		d.printf("%s:\n", name)
+	}
+	d.printf("%s%s%04d  %s\n", marker, bp, ins.Index, text)
+}
+
+func (d *Debugger) name(ip uint64) string {
+	if names := d.names[ip]; len(names) > 0 {
+		return names[0]
+	}
+	return strconv.FormatUint(ip, 10)
+}
+
+func (d *Debugger) printStack() {
+	stack := d.vm.Stack()
+	if len(stack) == 0 {
+		d.printf("empty\n")
+	}
+	for i := len(stack) - 1; i >= 0; i-- {
+		d.printf("%6d  %-20d 0x%016x\n", i, stack[i], stack[i])
+	}
+}
+
+// printFrame shows the slots of the current call frame and, inside a
+// function, the header written by CALL below it
+func (d *Debugger) printFrame() {
+	state := d.vm.State()
+	stack := d.vm.Stack()
+	if state.Base >= 3 {
+		d.printf("params %d  return %d  caller base %d\n", stack[state.Base-3], stack[state.Base-2], stack[state.Base-1])
+	} else {
+		d.printf("top level\n")
+	}
+	for i := state.Base; i < state.Depth; i++ {
+		d.printf("slot %-4d %-20d 0x%016x\n", i-state.Base, stack[i], stack[i])
+	}
+}
+
+func (d *Debugger) printMemory(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New("mem expects an offset and an optional size")
+	}
+	offset, err := strconv.ParseUint(args[0], 0, 64)
+	if err != nil {
+		return fmt.Errorf("invalid offset %s", args[0])
+	}
+	var size uint64 = 64
+	if len(args) == 2 {
+		if size, err = strconv.ParseUint(args[1], 0, 64); err != nil {
+			return fmt.Errorf("invalid size %s", args[1])
+		}
+	}
+	data, err := d.vm.ReadData(offset, size)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(data); i += 16 {
+		end := i + 16
+		if end > len(data) {
+			end = len(data)
+		}
+		d.printf("%08x  % x\n", offset+uint64(i), data[i:end])
+	}
+	return nil
+}
+
+func (d *Debugger) watch(args []string) error {
+	if len(args) == 0 || len(args) > 3 {
+		return errors.New("watch expects an offset, an optional size and kind")
+	}
+	offset, err := strconv.ParseUint(args[0], 0, 64)
+	if err != nil {
+		return fmt.Errorf("invalid offset %s", args[0])
+	}
+	var size uint64 = 8
+	if len(args) > 1 {
+		if size, err = strconv.ParseUint(args[1], 0, 64); err != nil {
+			return fmt.Errorf("invalid size %s", args[1])
+		}
+	}
+	if size == 0 || offset+size < offset {
+		return fmt.Errorf("invalid range of %d bytes at %d", size, offset)
+	}
+	kind := vm.WatchWrite
+	if len(args) > 2 {
+		kinds := map[string]vm.WatchKind{"r": vm.WatchRead, "w": vm.WatchWrite, "rw": vm.WatchAccess}
+		var ok bool
+		if kind, ok = kinds[args[2]]; !ok {
+			return fmt.Errorf("invalid kind %s", args[2])
+		}
+	}
+	id := d.vm.AddWatchpoint(vm.Watchpoint{Start: offset, End: offset + size, Kind: kind})
+	d.printf("watchpoint %d\n", id)
+	return nil
+}
+
+func (d *Debugger) printf(format string, args ...interface{}) {
+	fmt.Fprintf(d.out, format, args...)
+}
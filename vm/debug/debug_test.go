@@ -0,0 +1,113 @@
+package debug
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/nguyenzung/StackBasedVirtualMachine/vm"
+	"github.com/nguyenzung/StackBasedVirtualMachine/vm/asm"
+)
+
+const program = `
+	PUSH 4
+	PUSH 1
+	CALL double   ; 2
+	PUSH 1        ; 3
+	ADD
+	HLT
+double:
+	PUSH 0        ; 6
+	SLOAD
+	PUSH 0
+	SLOAD
+	ADD
+	RET           ; 11
+`
+
+func makeDebugger(t *testing.T, out io.Writer) *Debugger {
+	p, err := asm.Assemble([]byte(program))
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine := vm.MakeVM(8 * 10000000)
+	machine.FlashRom(p.Code)
+	return New(machine, p.Labels, out)
+}
+
+func TestStepping(t *testing.T) {
+	d := makeDebugger(t, io.Discard)
+	d.Step()
+	d.Step()
+	if stop, err := d.StepOver(); stop != Stepped || err != nil || d.vm.State().IP != 3 {
+		t.Fatalf("Step over CALL stopped at %d: %v %v", d.vm.State().IP, stop, err)
+	}
+	if stack := d.vm.Stack(); len(stack) != 1 || stack[0] != 8 {
+		t.Errorf("Stack %v after the call, expected [8]", stack)
+	}
+
+	d = makeDebugger(t, io.Discard)
+	d.AddBreakpoint(9)
+	if stop, _ := d.Continue(); stop != Breakpoint || d.vm.State().IP != 9 {
+		t.Fatalf("Continue stopped at %d with %v, expected breakpoint at 9", d.vm.State().IP, stop)
+	}
+	if stop, err := d.StepOut(); stop != Stepped || err != nil || d.vm.State().IP != 3 {
+		t.Fatalf("Step out stopped at %d: %v %v", d.vm.State().IP, stop, err)
+	}
+	if _, err := d.StepOut(); err == nil {
+		t.Errorf("Step out of the top level succeeded")
+	}
+	if stop, _ := d.Continue(); stop != Halted {
+		t.Errorf("Continue stopped with %v, expected halt", stop)
+	}
+	if stack := d.vm.Stack(); stack[0] != 9 {
+		t.Errorf("Result %d, expected 9", stack[0])
+	}
+}
+
+func TestCommands(t *testing.T) {
+	var out strings.Builder
+	d := makeDebugger(t, &out)
+	commands := "b double\nc\nframe\nstack\nl 3\nmem 0 4\nbogus\nq\n"
+	if err := d.Run(strings.NewReader(commands)); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"breakpoint\n",
+		"double:\n=>*0006  PUSH 0\n",
+		"params 1  return 3  caller base 0\n",
+		"slot 0    4 ",
+		"   0005  HLT\n",
+		"00000000  00 00 00 00\n",
+		"error: unknown command bogus\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Output misses %q:\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestWatchCommand(t *testing.T) {
+	p, err := asm.Assemble([]byte("PUSH 5\nPUSH 24\nSTORE\nPUSH 1\nHLT\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine := vm.MakeVM(8 * 10000000)
+	machine.FlashRom(p.Code)
+	var out strings.Builder
+	d := New(machine, nil, &out)
+	if err := d.Run(strings.NewReader("watch 24 0\nwatch 0xffffffffffffffff 2\nwatch 24\nc\nc\n")); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"error: invalid range of 0 bytes at 24\n",
+		"error: invalid range of 2 bytes at 18446744073709551615\n",
+		"watchpoint 1\n",
+		"watchpoint 1: write of 8 bytes at 24 by ip 2, 0 -> 5\n=> 0003  PUSH 1\n",
+		"halted\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Output misses %q:\n%s", expected, out.String())
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+)
+
+type FaultKind uint8
+
+const (
+	StackOverflow FaultKind = iota + 1
+	StackUnderflow
+	InvalidOpcode
+	MemoryOutOfBounds
+	DivisionByZero
+	BadCallFrame
+	OutOfGas
+	CallDepthExceeded
+	MemoryProtection
+	UnknownSyscall
+	InvalidFree
+	DoubleFree
+	UseAfterFree
+)
+
+var faultNames = map[FaultKind]string{
+	StackOverflow:     "stack overflow",
+	StackUnderflow:    "stack underflow",
+	InvalidOpcode:     "invalid opcode",
+	MemoryOutOfBounds: "memory out of bounds",
+	DivisionByZero:    "division by zero",
+	BadCallFrame:      "bad call frame",
+	OutOfGas:          "out of gas",
+	CallDepthExceeded: "call depth exceeded",
+	MemoryProtection:  "memory protection",
+	UnknownSyscall:    "unknown syscall",
+	InvalidFree:       "invalid free",
+	DoubleFree:        "double free",
+	UseAfterFree:      "use after free",
+}
+
+func (kind FaultKind) String() string {
+	if name, ok := faultNames[kind]; ok {
+		return name
+	}
+	return fmt.Sprintf("fault %d", uint8(kind))
+}
+
+// Fault is returned by CPU.Run when the guest program misbehaves. The CPU
+// halts on a fault, its state is left as it was at the faulting instruction.
+type Fault struct {
+	Kind   FaultKind
+	IP     uint64 // Index of the faulting instruction
+	Opcode uint8
+	Depth  uint32 // Stack depth at the time of the fault
+	Addr   uint64 // Memory address for memory faults
+	Gas    uint64 // Gas used when the fault occurred
+}
+
+func (fault *Fault) Error() string {
+	msg := fmt.Sprintf("%s at ip %d (opcode 0x%02x, stack depth %d)", fault.Kind, fault.IP, fault.Opcode, fault.Depth)
+	switch fault.Kind {
+	case MemoryOutOfBounds, MemoryProtection, UseAfterFree:
+		msg += fmt.Sprintf(", address %d", fault.Addr)
+	case OutOfGas:
+		msg += fmt.Sprintf(", %d gas used", fault.Gas)
+	}
+	return msg
+}
+
+// ErrRomFull is returned when a program does not fit in the ROM
+var ErrRomFull = errors.New("exceed ROM size")
+
+// ErrHalted is returned when stepping a CPU that has halted
+var ErrHalted = errors.New("CPU halted")
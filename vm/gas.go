@@ -0,0 +1,61 @@
+package vm
+
+// GasTable holds the cost charged for executing each opcode
+type GasTable [256]uint64
+
+// DefaultGasTable charges one unit per instruction, more for memory access,
+// calls and the slower arithmetic
+func DefaultGasTable() GasTable {
+	var table GasTable
+	for i := range table {
+		table[i] = 1
+	}
+	for _, opcode := range []uint8{LOAD, STORE, LOAD8, STORE8} {
+		table[opcode] = 3
+	}
+	for _, opcode := range []uint8{SLOAD, SSTORE, SLOAD8, SSTORE8, PUSH64, TIME} {
+		table[opcode] = 2
+	}
+	for _, opcode := range []uint8{CALL, RET, SYSCALL} {
+		table[opcode] = 5
+	}
+	for _, opcode := range []uint8{DIV, MOD, IDIV, SMOD, FDIV, FSQRT, POW, ALLOC, FREE, REALLOC} {
+		table[opcode] = 4
+	}
+	return table
+}
+
+type gasMeter struct {
+	table   GasTable
+	limit   uint64
+	used    uint64
+	limited bool
+}
+
+// charge accounts for one instruction, it fails without charging when the
+// instruction does not fit in the remaining budget
+func (gas *gasMeter) charge(opcode uint8) error {
+	cost := gas.table[opcode]
+	if gas.limited && gas.limit-gas.used < cost {
+		return &Fault{Kind: OutOfGas}
+	}
+	gas.used += cost
+	return nil
+}
+
+// SetGasLimit bounds the gas a program may use, Run returns an OutOfGas
+// fault when the next instruction would exceed it
+func (vm *VM) SetGasLimit(limit uint64) {
+	vm.cpu.gas.limit = limit
+	vm.cpu.gas.limited = true
+}
+
+// SetGasTable replaces the cost of every opcode
+func (vm *VM) SetGasTable(table GasTable) {
+	vm.cpu.gas.table = table
+}
+
+// GasUsed returns the gas charged so far
+func (vm *VM) GasUsed() uint64 {
+	return vm.cpu.gas.used
+}
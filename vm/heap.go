@@ -0,0 +1,264 @@
+package vm
+
+import "sort"
+
+// heapAlign is the alignment and the minimum size of heap blocks
+const heapAlign = 8
+
+// block is a range of the heap, offsets are relative to the data segment
+type block struct {
+	start uint64
+	size  uint64
+}
+
+// heap is a first fit allocator over the end of the data segment. Its
+// bookkeeping lives on the host so that guest programs cannot corrupt it.
+type heap struct {
+	start uint64
+	end   uint64
+	debug bool
+	free  []block // Sorted by start, adjacent blocks are merged
+	live  []block // Sorted by start
+	freed []block // Sorted by start, blocks freed in debug mode are never reused
+	stats HeapStats
+}
+
+// HeapStats describes the use of the heap
+type HeapStats struct {
+	Size        uint64 // Bytes managed by the allocator
+	InUse       uint64 // Bytes in live blocks
+	Peak        uint64 // Highest InUse
+	LiveBlocks  uint64
+	Allocs      uint64 // Blocks allocated, a REALLOC that moves a block counts as an alloc and a free
+	Frees       uint64
+	Failures    uint64 // ALLOC and REALLOC that found no block
+	LargestFree uint64 // Size of the largest free block
+}
+
+func makeHeap(config Config) heap {
+	start := uint64(config.DataSegmentSize - config.HeapSize)
+	end := uint64(config.DataSegmentSize)
+	// Offset 0 is the null pointer returned on failure, it is never allocated
+	if start == 0 && end > 0 {
+		start = heapAlign
+	}
+	h := heap{start: start, end: end, debug: config.HeapDebug}
+	if end > start {
+		h.free = []block{{start: start, size: (end - start) / heapAlign * heapAlign}}
+	}
+	h.stats.Size = end - start
+	return h
+}
+
+// HeapStats returns the statistics of the allocator
+func (vm *VM) HeapStats() HeapStats {
+	stats := vm.heap.stats
+	for _, b := range vm.heap.free {
+		if b.size > stats.LargestFree {
+			stats.LargestFree = b.size
+		}
+	}
+	return stats
+}
+
+// valid reports whether the blocks lie inside the heap without overlapping
+// and each list is sorted, as the allocator keeps them
+func (h *heap) valid() bool {
+	var all []block
+	for _, blocks := range [][]block{h.free, h.live, h.freed} {
+		for i, b := range blocks {
+			if b.size == 0 || b.start < h.start || b.start > h.end || b.size > h.end-b.start {
+				return false
+			}
+			if i > 0 && blocks[i-1].start >= b.start {
+				return false
+			}
+		}
+		all = append(all, blocks...)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].start < all[j].start })
+	for i := 1; i < len(all); i++ {
+		if all[i-1].start+all[i-1].size > all[i].start {
+			return false
+		}
+	}
+	return true
+}
+
+// find returns the position of the block starting at offset in blocks, or -1
+func find(blocks []block, offset uint64) int {
+	i := sort.Search(len(blocks), func(i int) bool {
+		return blocks[i].start+blocks[i].size > offset
+	})
+	if i < len(blocks) && blocks[i].start == offset {
+		return i
+	}
+	return -1
+}
+
+func insert(blocks []block, b block) []block {
+	i := sort.Search(len(blocks), func(i int) bool {
+		return blocks[i].start > b.start
+	})
+	blocks = append(blocks, block{})
+	copy(blocks[i+1:], blocks[i:])
+	blocks[i] = b
+	return blocks
+}
+
+func remove(blocks []block, i int) []block {
+	return append(blocks[:i], blocks[i+1:]...)
+}
+
+// alloc returns the offset of a block of at least size bytes, 0 when none fits
+func (h *heap) alloc(size uint64) uint64 {
+	if size > h.end {
+		h.stats.Failures++
+		return 0
+	}
+	size = (size + heapAlign - 1) / heapAlign * heapAlign
+	if size == 0 {
+		size = heapAlign
+	}
+	for i, b := range h.free {
+		if b.size < size {
+			continue
+		}
+		if b.size == size {
+			h.free = remove(h.free, i)
+		} else {
+			h.free[i] = block{start: b.start + size, size: b.size - size}
+		}
+		h.live = insert(h.live, block{start: b.start, size: size})
+		h.stats.Allocs++
+		h.stats.LiveBlocks++
+		h.stats.InUse += size
+		if h.stats.InUse > h.stats.Peak {
+			h.stats.Peak = h.stats.InUse
+		}
+		return b.start
+	}
+	h.stats.Failures++
+	return 0
+}
+
+// release frees the live block starting at offset
+func (h *heap) release(offset uint64) error {
+	i := find(h.live, offset)
+	if i < 0 {
+		if find(h.freed, offset) >= 0 {
+			return &Fault{Kind: DoubleFree}
+		}
+		return &Fault{Kind: InvalidFree}
+	}
+	b := h.live[i]
+	h.live = remove(h.live, i)
+	h.stats.Frees++
+	h.stats.LiveBlocks--
+	h.stats.InUse -= b.size
+	if h.debug {
+		h.freed = insert(h.freed, b)
+		return nil
+	}
+	h.free = insert(h.free, b)
+	// Merge with the neighbours
+	i = find(h.free, b.start)
+	if i+1 < len(h.free) && h.free[i].start+h.free[i].size == h.free[i+1].start {
+		h.free[i].size += h.free[i+1].size
+		h.free = remove(h.free, i+1)
+	}
+	if i > 0 && h.free[i-1].start+h.free[i-1].size == h.free[i].start {
+		h.free[i-1].size += h.free[i].size
+		h.free = remove(h.free, i)
+	}
+	return nil
+}
+
+// check faults accesses to freed blocks in debug mode
+func (h *heap) check(offset uint64, size uint64) error {
+	if !h.debug || size == 0 || offset+size <= h.start || offset >= h.end {
+		return nil
+	}
+	// The first freed block ending after offset is the only one that can
+	// overlap the access without starting past it
+	i := sort.Search(len(h.freed), func(i int) bool {
+		return h.freed[i].start+h.freed[i].size > offset
+	})
+	if i < len(h.freed) && h.freed[i].start < offset+size {
+		return &Fault{Kind: UseAfterFree}
+	}
+	return nil
+}
+
+// heapAddress is dataAddress for guest accesses, which are checked against
+// freed heap blocks in debug mode
+func (cpu *CPU) heapAddress(offset uint64, size uint64, perm Permission) (uint64, error) {
+	index, err := cpu.dataAddress(offset, size, perm)
+	if err != nil {
+		return 0, err
+	}
+	if err := cpu.vm.heap.check(offset, size); err != nil {
+		if fault, ok := err.(*Fault); ok {
+			fault.Addr = index
+		}
+		return 0, err
+	}
+	return index, nil
+}
+
+func (cpu *CPU) processALLOC() error {
+	size, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
+	return cpu.stack.Push(cpu.vm.heap.alloc(size))
+}
+
+func (cpu *CPU) processFREE() error {
+	offset, err := cpu.stack.Pop()
+	if err != nil {
+		return err
+	}
+	if offset == 0 {
+		return nil
+	}
+	return cpu.vm.heap.release(offset)
+}
+
+// processREALLOC resizes a block, moving it to a new block when it grows.
+// On failure it pushes 0 and the block is left as it was.
+func (cpu *CPU) processREALLOC() error {
+	offset, size, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	h := &cpu.vm.heap
+	if offset == 0 {
+		return cpu.stack.Push(h.alloc(size))
+	}
+	i := find(h.live, offset)
+	if i < 0 {
+		// Fails with the fault FREE would report
+		return h.release(offset)
+	}
+	if size == 0 {
+		if err := h.release(offset); err != nil {
+			return err
+		}
+		return cpu.stack.Push(0)
+	}
+	old := h.live[i]
+	if size <= old.size {
+		return cpu.stack.Push(offset)
+	}
+	moved := h.alloc(size)
+	if moved == 0 {
+		return cpu.stack.Push(0)
+	}
+	base := uint64(cpu.vm.getDataSegment())
+	copy(cpu.vm.memory[base+moved:base+moved+old.size], cpu.vm.memory[base+offset:base+offset+old.size])
+	if err := h.release(offset); err != nil {
+		return err
+	}
+	return cpu.stack.Push(moved)
+}
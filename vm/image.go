@@ -0,0 +1,234 @@
+package vm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// An image file is little endian and laid out as
+//
+//	magic      4 bytes "SVMI"
+//	version    uint16, ISA version the code was built for
+//	flags      uint16, reserved and 0
+//	entry      uint64, instruction index where execution starts
+//	code       uint64 number of words, then the words
+//	data       uint64 number of bytes, then the bytes
+//	symbols    uint64 number of symbols, then for each a uint16 name
+//	           length, the name and its uint64 instruction index
+//	checksum   uint32, CRC32 (IEEE) of everything before it
+const imageMagic = "SVMI"
+
+// ISAVersion is the version of the instruction set implemented by the CPU,
+// images built for a later version are rejected. Version 2 adds SYSCALL,
+// version 3 ALLOC, FREE and REALLOC.
+const ISAVersion uint16 = 3
+
+var (
+	ErrImageMagic     = errors.New("not a VM image")
+	ErrImageVersion   = errors.New("unsupported ISA version")
+	ErrImageTruncated = errors.New("truncated image")
+	ErrImageChecksum  = errors.New("image checksum mismatch")
+	ErrImageInvalid   = errors.New("invalid image")
+)
+
+// Image is a program with the initial content of its data segment
+type Image struct {
+	Version uint16
+	Entry   uint64
+	Code    []uint64
+	Data    []byte            // Copied to the start of the data segment
+	Symbols map[string]uint64 // Instruction index of named code addresses
+}
+
+// MaxImageSize bounds the sections of an image in bytes, no VM has more memory
+const MaxImageSize = 1<<32 - 1
+
+type imageHeader struct {
+	Magic   [4]byte
+	Version uint16
+	Flags   uint16
+	Entry   uint64
+}
+
+// validate checks the parts of an image a VM depends on
+func (image *Image) validate() error {
+	if image.Version > ISAVersion {
+		return fmt.Errorf("%w %d, the VM implements %d", ErrImageVersion, image.Version, ISAVersion)
+	}
+	if uint64(len(image.Code)) > MaxImageSize/8 || uint64(len(image.Data)) > MaxImageSize {
+		return fmt.Errorf("%w: sections exceed the 4GB memory limit", ErrImageInvalid)
+	}
+	if image.Entry >= uint64(len(image.Code)) && !(image.Entry == 0 && len(image.Code) == 0) {
+		return fmt.Errorf("%w: entry point %d is outside the code", ErrImageInvalid, image.Entry)
+	}
+	for name := range image.Symbols {
+		if name == "" || len(name) > 0xffff {
+			return fmt.Errorf("%w: bad symbol name length %d", ErrImageInvalid, len(name))
+		}
+	}
+	return nil
+}
+
+// WriteImage encodes image to w
+func WriteImage(w io.Writer, image *Image) error {
+	if err := image.validate(); err != nil {
+		return err
+	}
+	crc := crc32.NewIEEE()
+	out := bufio.NewWriter(io.MultiWriter(w, crc))
+	header := imageHeader{Version: image.Version, Entry: image.Entry}
+	copy(header.Magic[:], imageMagic)
+	write := func(data interface{}) {
+		// bufio.Writer keeps the first error and reports it on Flush
+		binary.Write(out, binary.LittleEndian, data)
+	}
+	write(header)
+	write(uint64(len(image.Code)))
+	write(image.Code)
+	write(uint64(len(image.Data)))
+	write(image.Data)
+	names := make([]string, 0, len(image.Symbols))
+	for name := range image.Symbols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	write(uint64(len(names)))
+	for _, name := range names {
+		write(uint16(len(name)))
+		write([]byte(name))
+		write(image.Symbols[name])
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, crc.Sum32())
+}
+
+// LoadImage decodes and validates an image written by WriteImage
+func LoadImage(r io.Reader) (*Image, error) {
+	crc := crc32.NewIEEE()
+	in := io.TeeReader(bufio.NewReader(r), crc)
+	read := func(data interface{}) error {
+		err := binary.Read(in, binary.LittleEndian, data)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrImageTruncated
+		}
+		return err
+	}
+
+	var header imageHeader
+	if err := read(&header); err != nil {
+		return nil, err
+	}
+	if string(header.Magic[:]) != imageMagic {
+		return nil, ErrImageMagic
+	}
+	if header.Flags != 0 {
+		return nil, fmt.Errorf("%w: unknown flags 0x%04x", ErrImageInvalid, header.Flags)
+	}
+	image := &Image{Version: header.Version, Entry: header.Entry, Symbols: make(map[string]uint64)}
+	if image.Version > ISAVersion {
+		return nil, fmt.Errorf("%w %d, the VM implements %d", ErrImageVersion, image.Version, ISAVersion)
+	}
+
+	var size uint64
+	if err := read(&size); err != nil {
+		return nil, err
+	}
+	if size > MaxImageSize/8 {
+		return nil, fmt.Errorf("%w: %d code words exceed the 4GB memory limit", ErrImageInvalid, size)
+	}
+	code, err := readSection(in, size*8)
+	if err != nil {
+		return nil, err
+	}
+	image.Code = make([]uint64, size)
+	for i := range image.Code {
+		image.Code[i] = binary.LittleEndian.Uint64(code[i*8:])
+	}
+	if err := read(&size); err != nil {
+		return nil, err
+	}
+	if size > MaxImageSize {
+		return nil, fmt.Errorf("%w: %d data bytes exceed the 4GB memory limit", ErrImageInvalid, size)
+	}
+	if image.Data, err = readSection(in, size); err != nil {
+		return nil, err
+	}
+	var count uint64
+	if err := read(&count); err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < count; i++ {
+		var length uint16
+		if err := read(&length); err != nil {
+			return nil, err
+		}
+		name := make([]byte, length)
+		if err := read(name); err != nil {
+			return nil, err
+		}
+		var value uint64
+		if err := read(&value); err != nil {
+			return nil, err
+		}
+		if _, ok := image.Symbols[string(name)]; ok {
+			return nil, fmt.Errorf("%w: duplicate symbol %s", ErrImageInvalid, name)
+		}
+		image.Symbols[string(name)] = value
+	}
+
+	sum := crc.Sum32()
+	var checksum uint32
+	if err := read(&checksum); err != nil {
+		return nil, err
+	}
+	if checksum != sum {
+		return nil, ErrImageChecksum
+	}
+	if err := image.validate(); err != nil {
+		return nil, err
+	}
+	return image, nil
+}
+
+// readSection reads size bytes in chunks, so that the size in a corrupted
+// header cannot allocate more memory than the image actually holds
+func readSection(r io.Reader, size uint64) ([]byte, error) {
+	const chunk = 1 << 20
+	data := make([]byte, 0)
+	for uint64(len(data)) < size {
+		n := size - uint64(len(data))
+		if n > chunk {
+			n = chunk
+		}
+		start := len(data)
+		data = append(data, make([]byte, n)...)
+		if _, err := io.ReadFull(r, data[start:]); err != nil {
+			return nil, ErrImageTruncated
+		}
+	}
+	return data, nil
+}
+
+// FlashImage flashes the code of image, copies its data to the data segment
+// below the heap and moves IP to its entry point
+func (vm *VM) FlashImage(image *Image) error {
+	if err := image.validate(); err != nil {
+		return err
+	}
+	if uint64(len(image.Data)) > uint64(vm.config.DataSegmentSize-vm.config.HeapSize) {
+		return fmt.Errorf("%w: %d data bytes exceed the data segment below the heap", ErrImageInvalid, len(image.Data))
+	}
+	if err := vm.FlashRom(image.Code); err != nil {
+		return err
+	}
+	copy(vm.memory[vm.getDataSegment():], image.Data)
+	vm.cpu.ip = image.Entry
+	return nil
+}
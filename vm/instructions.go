@@ -1,5 +1,7 @@
 package vm
 
+import "math"
+
 /*
 *	Each instruction has size 64 bits
 *	First 8 bits used for opcode
@@ -8,13 +10,14 @@ package vm
 var (
 	POP     uint8 = 0x01
 	PUSH    uint8 = 0x02
+	PUSHF   uint8 = 0x03 // Push the float64 whose upper 56 bits are the operand
 	ADD     uint8 = 0x04
 	SUB     uint8 = 0x05 // stack[i - 1] = stack[i - 1] - stack[i]
 	MUL     uint8 = 0x06
 	DIV     uint8 = 0x07
 	AND     uint8 = 0x08
 	OR      uint8 = 0x09
-	NAND    uint8 = 0x0A
+	NAND    uint8 = 0x0A // ^(stack[i - 1] & stack[i])
 	XOR     uint8 = 0x0B
 	NOT     uint8 = 0x0C
 	LT      uint8 = 0x0D // stack[i - 1] < stack[i]
@@ -24,27 +27,59 @@ var (
 	EQ      uint8 = 0x11 // stack[i - 1] == stack[i]
 	SHL     uint8 = 0x12 // Shift left stack[i - 1] by stack[i] bits
 	SHR     uint8 = 0x13 // Shift right stack[i - 1] by stack[i] bits
+	SAR     uint8 = 0x14 // Shift right stack[i - 1] by stack[i] bits, copying the sign bit
+	SLT     uint8 = 0x15 // Signed stack[i - 1] < stack[i]
+	SGT     uint8 = 0x16 // Signed stack[i - 1] > stack[i]
+	SLE     uint8 = 0x17 // Signed stack[i - 1] <= stack[i]
+	SGE     uint8 = 0x18 // Signed stack[i - 1] >= stack[i]
+	PUSH64  uint8 = 0x19 // Push the ROM word that follows the instruction
 	INC     uint8 = 0x20
 	DEC     uint8 = 0x21
 	MOD     uint8 = 0x22
-	POW     uint8 = 0x23
-	IMUL    uint8 = 0x24
-	IDIV    uint8 = 0x25
+	POW     uint8 = 0x23 // stack[i - 1] to the power stack[i], wraps around
+	IMUL    uint8 = 0x24 // Two's complement multiply
+	IDIV    uint8 = 0x25 // Two's complement divide, truncates toward zero
+	SDIV    uint8 = IDIV // Alias of IDIV
+	SMOD    uint8 = 0x26 // Signed remainder, takes the sign of stack[i - 1]
+	NEG     uint8 = 0x27 // Two's complement negation
+	ABS     uint8 = 0x28 // Absolute value of a signed number
+	SEXT8   uint8 = 0x29 // Sign extend the low 8 bits
+	SEXT16  uint8 = 0x2A // Sign extend the low 16 bits
+	SEXT32  uint8 = 0x2B // Sign extend the low 32 bits
 	DUP     uint8 = 0x38
 	SWAP    uint8 = 0x39
 	LOAD    uint8 = 0x40 // Load 8 bytes from memory that point by stack[i]
 	STORE   uint8 = 0x41 // Store 8 bytes at stack[i-1] to the memory that point by stack[i]
 	LOAD8   uint8 = 0x42 // Load 8 bytes from memory that point by stack[i]
 	STORE8  uint8 = 0x43 // Store 8 bytes at stack[i-1] to the memory that point by stack[i]
-	SLOAD   uint8 = 0x60
-	SSTORE  uint8 = 0x61
-	SLOAD8  uint8 = 0x62
-	SSTORE8 uint8 = 0x63
+	FADD    uint8 = 0x50 // Floating point stack[i - 1] + stack[i]
+	FSUB    uint8 = 0x51 // Floating point stack[i - 1] - stack[i]
+	FMUL    uint8 = 0x52 // Floating point stack[i - 1] * stack[i]
+	FDIV    uint8 = 0x53 // Floating point stack[i - 1] / stack[i]
+	FNEG    uint8 = 0x54
+	FSQRT   uint8 = 0x55
+	FEQ     uint8 = 0x56 // Floating point stack[i - 1] == stack[i], false for NaN
+	FLT     uint8 = 0x57 // Floating point stack[i - 1] < stack[i], false for NaN
+	FLE     uint8 = 0x58 // Floating point stack[i - 1] <= stack[i], false for NaN
+	FGT     uint8 = 0x59 // Floating point stack[i - 1] > stack[i], false for NaN
+	FGE     uint8 = 0x5A // Floating point stack[i - 1] >= stack[i], false for NaN
+	FCMP    uint8 = 0x5B // -1, 0 or 1 when stack[i - 1] is less, equal or greater than stack[i], 2 if unordered
+	I2F     uint8 = 0x5C // Signed integer to float
+	U2F     uint8 = 0x5D // Unsigned integer to float
+	F2I     uint8 = 0x5E // Float to signed integer, truncates and saturates, NaN gives 0
+	SLOAD   uint8 = 0x60 // Load slot stack[i] of the current call frame
+	SSTORE  uint8 = 0x61 // Store stack[i-1] to slot stack[i] of the current call frame
+	SLOAD8  uint8 = 0x62 // Load byte stack[i] of the current call frame
+	SSTORE8 uint8 = 0x63 // Store the low byte of stack[i-1] to byte stack[i] of the current call frame
 	CALL    uint8 = 0x80
 	RET     uint8 = 0x81
 	HLT     uint8 = 0x85
 	TIME    uint8 = 0x86
 	SPACE   uint8 = 0x87 // Load available RAM index after ROM
+	SYSCALL uint8 = 0x88 // Call the host service numbered by the operand
+	ALLOC   uint8 = 0x89 // Allocate stack[i] bytes of heap, push their data offset or 0
+	FREE    uint8 = 0x8A // Free the heap block at data offset stack[i]
+	REALLOC uint8 = 0x8B // Resize the heap block at stack[i-1] to stack[i] bytes, push its new offset or 0
 	JMP     uint8 = 0xA0 // Unconditinal jump
 	JN      uint8 = 0xA1 // Jump if negative
 	JP      uint8 = 0xA2 // Jump if positive
@@ -56,8 +91,154 @@ var (
 	JGT     uint8 = 0xA8 // Jump to stack[i] if stack[i-2] greater than stack[i-1]
 	JLE     uint8 = 0xA9 // Jump to stack[i] if stack[i-2] less or equal stack[i-1]
 	JGE     uint8 = 0xAA // Jump to stack[i] if stack[i-2] greater or equal stack[i-1]
+	JSLT    uint8 = 0xAB // Jump to stack[i] if signed stack[i-2] less than stack[i-1]
+	JSGT    uint8 = 0xAC // Jump to stack[i] if signed stack[i-2] greater than stack[i-1]
+	JSLE    uint8 = 0xAD // Jump to stack[i] if signed stack[i-2] less or equal stack[i-1]
+	JSGE    uint8 = 0xAE // Jump to stack[i] if signed stack[i-2] greater or equal stack[i-1]
 )
 
+// OpInfo describes an opcode for tools that work on encoded programs
+type OpInfo struct {
+	Name    string
+	Operand bool // The lower 56 bits hold an immediate operand
+	Jump    bool // Pops its destination from the stack
+	Wide    bool // Followed by a ROM word holding a 64 bit immediate
+	Pops    int  // Values the instruction needs on the stack
+	Pushes  int  // Values on the stack in their place afterwards
+	Dynamic bool // Also pops and pushes values that depend on the operand or the callee
+}
+
+// Words is the number of ROM words taken by the instruction
+func (info OpInfo) Words() int {
+	if info.Wide {
+		return 2
+	}
+	return 1
+}
+
+var opcodes = map[uint8]OpInfo{
+	POP:     {Name: "POP", Pops: 1},
+	PUSH:    {Name: "PUSH", Operand: true, Pushes: 1},
+	PUSHF:   {Name: "PUSHF", Operand: true, Pushes: 1},
+	ADD:     {Name: "ADD", Pops: 2, Pushes: 1},
+	SUB:     {Name: "SUB", Pops: 2, Pushes: 1},
+	MUL:     {Name: "MUL", Pops: 2, Pushes: 1},
+	DIV:     {Name: "DIV", Pops: 2, Pushes: 1},
+	AND:     {Name: "AND", Pops: 2, Pushes: 1},
+	OR:      {Name: "OR", Pops: 2, Pushes: 1},
+	NAND:    {Name: "NAND", Pops: 2, Pushes: 1},
+	XOR:     {Name: "XOR", Pops: 2, Pushes: 1},
+	NOT:     {Name: "NOT", Pops: 1, Pushes: 1},
+	LT:      {Name: "LT", Pops: 2, Pushes: 1},
+	GT:      {Name: "GT", Pops: 2, Pushes: 1},
+	LTE:     {Name: "LTE", Pops: 2, Pushes: 1},
+	GTE:     {Name: "GTE", Pops: 2, Pushes: 1},
+	EQ:      {Name: "EQ", Pops: 2, Pushes: 1},
+	SHL:     {Name: "SHL", Pops: 2, Pushes: 1},
+	SHR:     {Name: "SHR", Pops: 2, Pushes: 1},
+	SAR:     {Name: "SAR", Pops: 2, Pushes: 1},
+	SLT:     {Name: "SLT", Pops: 2, Pushes: 1},
+	SGT:     {Name: "SGT", Pops: 2, Pushes: 1},
+	SLE:     {Name: "SLE", Pops: 2, Pushes: 1},
+	SGE:     {Name: "SGE", Pops: 2, Pushes: 1},
+	PUSH64:  {Name: "PUSH64", Wide: true, Pushes: 1},
+	INC:     {Name: "INC", Pops: 1, Pushes: 1},
+	DEC:     {Name: "DEC", Pops: 1, Pushes: 1},
+	MOD:     {Name: "MOD", Pops: 2, Pushes: 1},
+	POW:     {Name: "POW", Pops: 2, Pushes: 1},
+	IMUL:    {Name: "IMUL", Pops: 2, Pushes: 1},
+	IDIV:    {Name: "IDIV", Pops: 2, Pushes: 1},
+	SMOD:    {Name: "SMOD", Pops: 2, Pushes: 1},
+	NEG:     {Name: "NEG", Pops: 1, Pushes: 1},
+	ABS:     {Name: "ABS", Pops: 1, Pushes: 1},
+	SEXT8:   {Name: "SEXT8", Pops: 1, Pushes: 1},
+	SEXT16:  {Name: "SEXT16", Pops: 1, Pushes: 1},
+	SEXT32:  {Name: "SEXT32", Pops: 1, Pushes: 1},
+	DUP:     {Name: "DUP", Pops: 1, Pushes: 2},
+	SWAP:    {Name: "SWAP", Pops: 2, Pushes: 2},
+	LOAD:    {Name: "LOAD", Pops: 1, Pushes: 1},
+	STORE:   {Name: "STORE", Pops: 2},
+	LOAD8:   {Name: "LOAD8", Pops: 1, Pushes: 1},
+	STORE8:  {Name: "STORE8", Pops: 2},
+	FADD:    {Name: "FADD", Pops: 2, Pushes: 1},
+	FSUB:    {Name: "FSUB", Pops: 2, Pushes: 1},
+	FMUL:    {Name: "FMUL", Pops: 2, Pushes: 1},
+	FDIV:    {Name: "FDIV", Pops: 2, Pushes: 1},
+	FNEG:    {Name: "FNEG", Pops: 1, Pushes: 1},
+	FSQRT:   {Name: "FSQRT", Pops: 1, Pushes: 1},
+	FEQ:     {Name: "FEQ", Pops: 2, Pushes: 1},
+	FLT:     {Name: "FLT", Pops: 2, Pushes: 1},
+	FLE:     {Name: "FLE", Pops: 2, Pushes: 1},
+	FGT:     {Name: "FGT", Pops: 2, Pushes: 1},
+	FGE:     {Name: "FGE", Pops: 2, Pushes: 1},
+	FCMP:    {Name: "FCMP", Pops: 2, Pushes: 1},
+	I2F:     {Name: "I2F", Pops: 1, Pushes: 1},
+	U2F:     {Name: "U2F", Pops: 1, Pushes: 1},
+	F2I:     {Name: "F2I", Pops: 1, Pushes: 1},
+	SLOAD:   {Name: "SLOAD", Pops: 1, Pushes: 1},
+	SSTORE:  {Name: "SSTORE", Pops: 2},
+	SLOAD8:  {Name: "SLOAD8", Pops: 1, Pushes: 1},
+	SSTORE8: {Name: "SSTORE8", Pops: 2},
+	CALL:    {Name: "CALL", Operand: true, Pops: 1, Dynamic: true},
+	RET:     {Name: "RET"},
+	HLT:     {Name: "HLT"},
+	TIME:    {Name: "TIME", Pushes: 1},
+	SPACE:   {Name: "SPACE", Pushes: 1},
+	SYSCALL: {Name: "SYSCALL", Operand: true, Dynamic: true},
+	ALLOC:   {Name: "ALLOC", Pops: 1, Pushes: 1},
+	FREE:    {Name: "FREE", Pops: 1},
+	REALLOC: {Name: "REALLOC", Pops: 2, Pushes: 1},
+	JMP:     {Name: "JMP", Jump: true, Pops: 1},
+	JN:      {Name: "JN", Jump: true, Pops: 2},
+	JP:      {Name: "JP", Jump: true, Pops: 2},
+	JZ:      {Name: "JZ", Jump: true, Pops: 2},
+	JNZ:     {Name: "JNZ", Jump: true, Pops: 2},
+	JE:      {Name: "JE", Jump: true, Pops: 3},
+	JNE:     {Name: "JNE", Jump: true, Pops: 3},
+	JLT:     {Name: "JLT", Jump: true, Pops: 3},
+	JGT:     {Name: "JGT", Jump: true, Pops: 3},
+	JLE:     {Name: "JLE", Jump: true, Pops: 3},
+	JGE:     {Name: "JGE", Jump: true, Pops: 3},
+	JSLT:    {Name: "JSLT", Jump: true, Pops: 3},
+	JSGT:    {Name: "JSGT", Jump: true, Pops: 3},
+	JSLE:    {Name: "JSLE", Jump: true, Pops: 3},
+	JSGE:    {Name: "JSGE", Jump: true, Pops: 3},
+}
+
+var opcodeNames = make(map[string]uint8)
+
+func init() {
+	for opcode, info := range opcodes {
+		opcodeNames[info.Name] = opcode
+	}
+	opcodeNames["SDIV"] = SDIV
+}
+
+// LookupOpcode returns the description of opcode, ok is false for unknown opcodes
+func LookupOpcode(opcode uint8) (OpInfo, bool) {
+	info, ok := opcodes[opcode]
+	return info, ok
+}
+
+// OpcodeByName resolves an upper case mnemonic such as "PUSH" to its opcode
+func OpcodeByName(name string) (uint8, bool) {
+	opcode, ok := opcodeNames[name]
+	return opcode, ok
+}
+
+// Encode packs opcode and the lower 56 bits of operand into one instruction
+func Encode(opcode uint8, operand uint64) uint64 {
+	return uint64(opcode)<<56 | operand&MaxOperand
+}
+
+// Decode splits an instruction into its opcode and 56 bit operand
+func Decode(instruction uint64) (uint8, uint64) {
+	return uint8(instruction >> 56), instruction & MaxOperand
+}
+
+// MaxOperand is the largest immediate an instruction can carry
+const MaxOperand uint64 = 1<<56 - 1
+
 func MakePOP() uint64 {
 	var opcode uint64 = uint64(POP)
 	opcode = opcode << 56
@@ -73,6 +254,28 @@ func MakePUSH(value uint64) uint64 {
 	return value
 }
 
+// MakePUSHF keeps the upper 56 bits of value, the lowest 8 bits of the
+// mantissa are dropped unless FloatFitsOperand(value)
+func MakePUSHF(value float64) uint64 {
+	bits := math.Float64bits(value) >> 8
+	var opcode uint64 = uint64(PUSHF)
+	opcode = opcode << 56
+	bits = bits | opcode
+	return bits
+}
+
+// FloatFitsOperand reports whether PUSHF can push value without rounding
+func FloatFitsOperand(value float64) bool {
+	return math.Float64bits(value)&0xff == 0
+}
+
+// MakePUSH64 returns the instruction followed by the immediate word, both go to the ROM
+func MakePUSH64(value uint64) []uint64 {
+	var opcode uint64 = uint64(PUSH64)
+	opcode = opcode << 56
+	return []uint64{opcode, value}
+}
+
 func MakeADD() uint64 {
 	var opcode uint64 = uint64(ADD)
 	opcode = opcode << 56
@@ -121,6 +324,12 @@ func MakeXOR() uint64 {
 	return opcode
 }
 
+func MakeNAND() uint64 {
+	var opcode uint64 = uint64(NAND)
+	opcode = opcode << 56
+	return opcode
+}
+
 func MakeNOT() uint64 {
 	var opcode uint64 = uint64(NOT)
 	opcode = opcode << 56
@@ -169,6 +378,36 @@ func MakeSHR() uint64 {
 	return opcode
 }
 
+func MakeSAR() uint64 {
+	var opcode uint64 = uint64(SAR)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeSLT() uint64 {
+	var opcode uint64 = uint64(SLT)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeSGT() uint64 {
+	var opcode uint64 = uint64(SGT)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeSLE() uint64 {
+	var opcode uint64 = uint64(SLE)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeSGE() uint64 {
+	var opcode uint64 = uint64(SGE)
+	opcode = opcode << 56
+	return opcode
+}
+
 func MakeINC() uint64 {
 	var opcode uint64 = uint64(INC)
 	opcode = opcode << 56
@@ -199,6 +438,48 @@ func MakeIDIV() uint64 {
 	return opcode
 }
 
+func MakeSDIV() uint64 {
+	var opcode uint64 = uint64(SDIV)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeSMOD() uint64 {
+	var opcode uint64 = uint64(SMOD)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeNEG() uint64 {
+	var opcode uint64 = uint64(NEG)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeABS() uint64 {
+	var opcode uint64 = uint64(ABS)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeSEXT8() uint64 {
+	var opcode uint64 = uint64(SEXT8)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeSEXT16() uint64 {
+	var opcode uint64 = uint64(SEXT16)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeSEXT32() uint64 {
+	var opcode uint64 = uint64(SEXT32)
+	opcode = opcode << 56
+	return opcode
+}
+
 func MakeDUP() uint64 {
 	var opcode uint64 = uint64(DUP)
 	opcode = opcode << 56
@@ -235,6 +516,96 @@ func MakeSTORE8() uint64 {
 	return opcode
 }
 
+func MakeFADD() uint64 {
+	var opcode uint64 = uint64(FADD)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeFSUB() uint64 {
+	var opcode uint64 = uint64(FSUB)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeFMUL() uint64 {
+	var opcode uint64 = uint64(FMUL)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeFDIV() uint64 {
+	var opcode uint64 = uint64(FDIV)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeFNEG() uint64 {
+	var opcode uint64 = uint64(FNEG)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeFSQRT() uint64 {
+	var opcode uint64 = uint64(FSQRT)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeFEQ() uint64 {
+	var opcode uint64 = uint64(FEQ)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeFLT() uint64 {
+	var opcode uint64 = uint64(FLT)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeFLE() uint64 {
+	var opcode uint64 = uint64(FLE)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeFGT() uint64 {
+	var opcode uint64 = uint64(FGT)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeFGE() uint64 {
+	var opcode uint64 = uint64(FGE)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeFCMP() uint64 {
+	var opcode uint64 = uint64(FCMP)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeI2F() uint64 {
+	var opcode uint64 = uint64(I2F)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeU2F() uint64 {
+	var opcode uint64 = uint64(U2F)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeF2I() uint64 {
+	var opcode uint64 = uint64(F2I)
+	opcode = opcode << 56
+	return opcode
+}
+
 func MakeSLOAD() uint64 {
 	var opcode uint64 = uint64(SLOAD)
 	opcode = opcode << 56
@@ -247,6 +618,18 @@ func MakeSSTORE() uint64 {
 	return opcode
 }
 
+func MakeSLOAD8() uint64 {
+	var opcode uint64 = uint64(SLOAD8)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeSSTORE8() uint64 {
+	var opcode uint64 = uint64(SSTORE8)
+	opcode = opcode << 56
+	return opcode
+}
+
 func MakeCALL(label uint64) uint64 {
 	label = label << 8
 	label = label >> 8
@@ -280,6 +663,33 @@ func MakeTIME() uint64 {
 	return opcode
 }
 
+func MakeSYSCALL(service uint64) uint64 {
+	service = service << 8
+	service = service >> 8
+	var opcode uint64 = uint64(SYSCALL)
+	opcode = opcode << 56
+	service = service | opcode
+	return service
+}
+
+func MakeALLOC() uint64 {
+	var opcode uint64 = uint64(ALLOC)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeFREE() uint64 {
+	var opcode uint64 = uint64(FREE)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeREALLOC() uint64 {
+	var opcode uint64 = uint64(REALLOC)
+	opcode = opcode << 56
+	return opcode
+}
+
 func MakeJMP() uint64 {
 	var opcode uint64 = uint64(JMP)
 	opcode = opcode << 56
@@ -345,3 +755,27 @@ func MakeJGE() uint64 {
 	opcode = opcode << 56
 	return opcode
 }
+
+func MakeJSLT() uint64 {
+	var opcode uint64 = uint64(JSLT)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeJSGT() uint64 {
+	var opcode uint64 = uint64(JSGT)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeJSLE() uint64 {
+	var opcode uint64 = uint64(JSLE)
+	opcode = opcode << 56
+	return opcode
+}
+
+func MakeJSGE() uint64 {
+	var opcode uint64 = uint64(JSGE)
+	opcode = opcode << 56
+	return opcode
+}
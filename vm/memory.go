@@ -0,0 +1,89 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Permission is a set of allowed accesses to a memory segment
+type Permission uint8
+
+const (
+	PermRead Permission = 1 << iota
+	PermWrite
+	PermExecute
+)
+
+func (perm Permission) String() string {
+	flags := []byte("---")
+	if perm&PermRead != 0 {
+		flags[0] = 'r'
+	}
+	if perm&PermWrite != 0 {
+		flags[1] = 'w'
+	}
+	if perm&PermExecute != 0 {
+		flags[2] = 'x'
+	}
+	return string(flags)
+}
+
+// Segment is a range of memory addresses, Start included and End excluded.
+// Memory past the last segment cannot be accessed.
+type Segment struct {
+	Name  string
+	Start uint64
+	End   uint64
+	Perm  Permission
+}
+
+// makeSegments lays out the ROM, code and data segments of config
+func makeSegments(config Config) []Segment {
+	rom := uint64(config.RomSize)
+	code := rom + uint64(config.CodeSegmentSize)
+	data := code + uint64(config.DataSegmentSize)
+	return []Segment{
+		{Name: "rom", Start: 0, End: rom, Perm: PermRead | PermExecute},
+		{Name: "code", Start: rom, End: code, Perm: PermRead | PermExecute},
+		{Name: "data", Start: code, End: data, Perm: PermRead | PermWrite},
+	}
+}
+
+// Segments returns the memory segments with their permissions
+func (vm *VM) Segments() []Segment {
+	segments := make([]Segment, len(vm.segments))
+	copy(segments, vm.segments)
+	return segments
+}
+
+// Protect replaces the permissions of the segment called name
+func (vm *VM) Protect(name string, perm Permission) error {
+	for i := range vm.segments {
+		if vm.segments[i].Name == name {
+			vm.segments[i].Perm = perm
+			return nil
+		}
+	}
+	names := make([]string, len(vm.segments))
+	for i, segment := range vm.segments {
+		names[i] = segment.Name
+	}
+	return fmt.Errorf("unknown segment %s, expected one of %s", name, strings.Join(names, ", "))
+}
+
+// checkAccess returns a fault unless size bytes at addr are in memory and
+// inside a single segment that allows perm
+func (vm *VM) checkAccess(addr uint64, size uint64, perm Permission) error {
+	if addr > uint64(len(vm.memory)) || uint64(len(vm.memory))-addr < size {
+		return &Fault{Kind: MemoryOutOfBounds, Addr: addr}
+	}
+	for _, segment := range vm.segments {
+		if addr >= segment.Start && addr < segment.End {
+			if segment.End-addr < size || segment.Perm&perm != perm {
+				break
+			}
+			return nil
+		}
+	}
+	return &Fault{Kind: MemoryProtection, Addr: addr}
+}
@@ -0,0 +1,87 @@
+package vm
+
+// pprofMessage is a protocol buffer message under construction, it only
+// supports the wire types needed by the profile.proto messages
+type pprofMessage []byte
+
+func (msg *pprofMessage) varint(value uint64) {
+	for value >= 0x80 {
+		*msg = append(*msg, byte(value)|0x80)
+		value >>= 7
+	}
+	*msg = append(*msg, byte(value))
+}
+
+func (msg *pprofMessage) uint(field int, value uint64) {
+	if value == 0 {
+		return
+	}
+	msg.varint(uint64(field) << 3)
+	msg.varint(value)
+}
+
+func (msg *pprofMessage) int(field int, value int64) {
+	msg.uint(field, uint64(value))
+}
+
+func (msg *pprofMessage) bytes(field int, value []byte) {
+	msg.varint(uint64(field)<<3 | 2)
+	msg.varint(uint64(len(value)))
+	*msg = append(*msg, value...)
+}
+
+func (msg *pprofMessage) packed(field int, values []uint64) {
+	var data pprofMessage
+	for _, value := range values {
+		data.varint(value)
+	}
+	msg.bytes(field, data)
+}
+
+// pprofBuilder collects the repeated fields of a Profile message
+type pprofBuilder struct {
+	sampleTypes pprofMessage
+	samples     pprofMessage
+	mappings    pprofMessage
+	locations   pprofMessage
+	functions   pprofMessage
+	strings     map[string]int64
+	table       []string
+}
+
+// str returns the index of s in the string table
+func (p *pprofBuilder) str(s string) int64 {
+	if index, ok := p.strings[s]; ok {
+		return index
+	}
+	index := int64(len(p.table))
+	p.strings[s] = index
+	p.table = append(p.table, s)
+	return index
+}
+
+func (p *pprofBuilder) valueType(field int, kind string, unit string) {
+	var msg pprofMessage
+	msg.int(1, p.str(kind))
+	msg.int(2, p.str(unit))
+	p.sampleTypes.bytes(field, msg)
+}
+
+func (p *pprofBuilder) encode() []byte {
+	var period pprofMessage
+	period.int(1, p.str("instructions"))
+	period.int(2, p.str("count"))
+
+	var msg pprofMessage
+	msg = append(msg, p.sampleTypes...)
+	msg = append(msg, p.samples...)
+	msg = append(msg, p.mappings...)
+	msg = append(msg, p.locations...)
+	msg = append(msg, p.functions...)
+	for _, s := range p.table {
+		msg.bytes(6, []byte(s))
+	}
+	msg.bytes(11, period)
+	msg.int(12, 1)
+	return msg
+}
@@ -0,0 +1,196 @@
+package vm
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Profiler counts executed instructions per IP and per opcode and attributes
+// them, with their gas cost as cycles, to the call stack built by CALL and RET
+type Profiler struct {
+	ips     map[uint64]uint64
+	opcodes [256]uint64
+	root    *callNode
+	current *callNode
+}
+
+// callNode is one call path, children are keyed by call site and target
+type callNode struct {
+	parent   *callNode
+	function uint64 // Entry IP of the function
+	site     uint64 // IP of the CALL in the parent
+	children map[[2]uint64]*callNode
+	counts   map[uint64]*[2]uint64 // Executions and cycles per IP
+}
+
+// NewProfiler profiles from the current instruction, which is attributed to
+// a top level function entered at IP 0
+func NewProfiler() *Profiler {
+	root := newCallNode(nil, 0, 0)
+	return &Profiler{ips: make(map[uint64]uint64), root: root, current: root}
+}
+
+func newCallNode(parent *callNode, function uint64, site uint64) *callNode {
+	return &callNode{
+		parent:   parent,
+		function: function,
+		site:     site,
+		children: make(map[[2]uint64]*callNode),
+		counts:   make(map[uint64]*[2]uint64),
+	}
+}
+
+// SetProfiler starts profiling with profiler, nil stops profiling
+func (vm *VM) SetProfiler(profiler *Profiler) {
+	vm.cpu.profiler = profiler
+}
+
+// Executions returns how many times the instruction at ip was executed
+func (profiler *Profiler) Executions(ip uint64) uint64 {
+	return profiler.ips[ip]
+}
+
+// OpcodeExecutions returns how many instructions with opcode were executed
+func (profiler *Profiler) OpcodeExecutions(opcode uint8) uint64 {
+	return profiler.opcodes[opcode]
+}
+
+// count records a successfully executed instruction
+func (profiler *Profiler) count(ip uint64, opcode uint8, operand uint64, cost uint64) {
+	profiler.ips[ip]++
+	profiler.opcodes[opcode]++
+	node := profiler.current
+	counts := node.counts[ip]
+	if counts == nil {
+		counts = new([2]uint64)
+		node.counts[ip] = counts
+	}
+	counts[0]++
+	counts[1] += cost
+	switch opcode {
+	case CALL:
+		key := [2]uint64{ip, operand}
+		child := node.children[key]
+		if child == nil {
+			child = newCallNode(node, operand, ip)
+			node.children[key] = child
+		}
+		profiler.current = child
+	case RET:
+		// RET of a frame entered before profiling started stays at the root
+		if node.parent != nil {
+			profiler.current = node.parent
+		}
+	}
+}
+
+// WritePprof writes the profile in the gzipped protobuf format read by
+// go tool pprof. Functions are named after the labels in symbols that
+// match their entry IP, the others get a name made of their entry IP.
+func (profiler *Profiler) WritePprof(w io.Writer, symbols map[string]uint64) error {
+	names := make(map[uint64]string)
+	for name, ip := range symbols {
+		if old, ok := names[ip]; !ok || name < old {
+			names[ip] = name
+		}
+	}
+	p := &pprofBuilder{strings: map[string]int64{"": 0}, table: []string{""}}
+	p.valueType(1, "instructions", "count")
+	p.valueType(1, "cycles", "gas")
+
+	var functions = make(map[uint64]uint64)
+	function := func(entry uint64) uint64 {
+		if id, ok := functions[entry]; ok {
+			return id
+		}
+		name, ok := names[entry]
+		if !ok {
+			name = fmt.Sprintf("func_%04d", entry)
+			if entry == 0 {
+				name = "main"
+			}
+		}
+		id := uint64(len(functions) + 1)
+		functions[entry] = id
+		var msg pprofMessage
+		msg.uint(1, id)
+		msg.int(2, p.str(name))
+		msg.int(3, p.str(name))
+		msg.int(4, p.str("rom"))
+		msg.int(5, int64(entry))
+		p.functions.bytes(5, msg)
+		return id
+	}
+	var locations = make(map[[2]uint64]uint64)
+	location := func(ip uint64, entry uint64) uint64 {
+		key := [2]uint64{ip, entry}
+		if id, ok := locations[key]; ok {
+			return id
+		}
+		id := uint64(len(locations) + 1)
+		locations[key] = id
+		var line pprofMessage
+		line.uint(1, function(entry))
+		line.int(2, int64(ip))
+		var msg pprofMessage
+		msg.uint(1, id)
+		msg.uint(2, 1)
+		msg.uint(3, ip)
+		msg.bytes(4, line)
+		p.locations.bytes(4, msg)
+		return id
+	}
+
+	var walk func(node *callNode)
+	walk = func(node *callNode) {
+		ips := make([]uint64, 0, len(node.counts))
+		for ip := range node.counts {
+			ips = append(ips, ip)
+		}
+		sort.Slice(ips, func(i, j int) bool { return ips[i] < ips[j] })
+		for _, ip := range ips {
+			// Leaf first, then the call sites up to the root
+			stack := []uint64{location(ip, node.function)}
+			for frame := node; frame.parent != nil; frame = frame.parent {
+				stack = append(stack, location(frame.site, frame.parent.function))
+			}
+			counts := node.counts[ip]
+			var msg pprofMessage
+			msg.packed(1, stack)
+			msg.packed(2, counts[:])
+			p.samples.bytes(2, msg)
+		}
+		keys := make([][2]uint64, 0, len(node.children))
+		for key := range node.children {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i][0] < keys[j][0] || (keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1])
+		})
+		for _, key := range keys {
+			walk(node.children[key])
+		}
+	}
+	walk(profiler.root)
+
+	var limit uint64
+	for ip := range profiler.ips {
+		if ip >= limit {
+			limit = ip + 1
+		}
+	}
+	var mapping pprofMessage
+	mapping.uint(1, 1)
+	mapping.uint(3, limit)
+	mapping.int(5, p.str("rom"))
+	mapping.uint(7, 1)
+	p.mappings.bytes(3, mapping)
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(p.encode()); err != nil {
+		return err
+	}
+	return zw.Close()
+}
@@ -0,0 +1,195 @@
+package vm
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A snapshot is the magic "SVMS", a uint16 little endian format version and
+// a gzip stream holding a gob encoded snapshotState
+const (
+	snapshotMagic   = "SVMS"
+	snapshotVersion = 1
+	snapshotPage    = 4096 // Memory is saved by pages, zero pages are skipped
+)
+
+// ErrSnapshotInvalid is wrapped by the errors of Restore
+var ErrSnapshotInvalid = errors.New("invalid snapshot")
+
+// snapshotState mirrors the machine state with exported fields for gob
+type snapshotState struct {
+	Config      Config
+	Permissions []Permission
+	Pages       []memoryPage
+	Rom         []uint64
+
+	IP     uint64
+	Halted bool
+	Steps  uint64
+
+	GasTable   GasTable
+	GasLimit   uint64
+	GasUsed    uint64
+	GasLimited bool
+
+	Stack []uint64
+	Base  uint32
+	Calls uint32
+
+	HeapFree  [][2]uint64
+	HeapLive  [][2]uint64
+	HeapFreed [][2]uint64
+	HeapStats HeapStats
+
+	Random uint64
+}
+
+type memoryPage struct {
+	Index uint32
+	Data  []byte
+}
+
+// Snapshot writes the state of the machine so that Restore can resume it
+// exactly where it is. Watchpoints, syscalls, standard I/O, the clock, the
+// tracer and the profiler belong to the host and are not saved.
+func (vm *VM) Snapshot(w io.Writer) error {
+	cpu := vm.cpu
+	state := snapshotState{
+		Config:     vm.config,
+		Rom:        vm.rom,
+		IP:         cpu.ip,
+		Halted:     cpu.hlt,
+		Steps:      cpu.steps,
+		GasTable:   cpu.gas.table,
+		GasLimit:   cpu.gas.limit,
+		GasUsed:    cpu.gas.used,
+		GasLimited: cpu.gas.limited,
+		Stack:      cpu.stack.data[:cpu.stack.index],
+		Base:       cpu.stack.baseIndex,
+		Calls:      cpu.stack.calls,
+		HeapFree:   blockPairs(vm.heap.free),
+		HeapLive:   blockPairs(vm.heap.live),
+		HeapFreed:  blockPairs(vm.heap.freed),
+		HeapStats:  vm.heap.stats,
+		Random:     uint64(vm.random),
+	}
+	for _, segment := range vm.segments {
+		state.Permissions = append(state.Permissions, segment.Perm)
+	}
+	for start := 0; start < len(vm.memory); start += snapshotPage {
+		end := start + snapshotPage
+		if end > len(vm.memory) {
+			end = len(vm.memory)
+		}
+		if !isZero(vm.memory[start:end]) {
+			state.Pages = append(state.Pages, memoryPage{Index: uint32(start / snapshotPage), Data: vm.memory[start:end]})
+		}
+	}
+
+	if _, err := io.WriteString(w, snapshotMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint16(snapshotVersion)); err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(w)
+	if err := gob.NewEncoder(zw).Encode(&state); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// Restore makes a VM from a snapshot written by VM.Snapshot, continue it
+// with VM.Continue or VM.Step
+func Restore(r io.Reader) (*VM, error) {
+	var header struct {
+		Magic   [4]byte
+		Version uint16
+	}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotInvalid, err)
+	}
+	if string(header.Magic[:]) != snapshotMagic {
+		return nil, fmt.Errorf("%w: bad magic", ErrSnapshotInvalid)
+	}
+	if header.Version != snapshotVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrSnapshotInvalid, header.Version)
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotInvalid, err)
+	}
+	var state snapshotState
+	if err := gob.NewDecoder(zr).Decode(&state); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotInvalid, err)
+	}
+
+	vm, err := NewVM(state.Config)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotInvalid, err)
+	}
+	if len(state.Permissions) != len(vm.segments) {
+		return nil, fmt.Errorf("%w: %d segments, expected %d", ErrSnapshotInvalid, len(state.Permissions), len(vm.segments))
+	}
+	for i, perm := range state.Permissions {
+		vm.segments[i].Perm = perm
+	}
+	for _, page := range state.Pages {
+		start := uint64(page.Index) * snapshotPage
+		if start+uint64(len(page.Data)) > uint64(len(vm.memory)) {
+			return nil, fmt.Errorf("%w: page %d outside memory", ErrSnapshotInvalid, page.Index)
+		}
+		copy(vm.memory[start:], page.Data)
+	}
+	if err := vm.FlashRom(state.Rom); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotInvalid, err)
+	}
+
+	cpu, stack := vm.cpu, vm.cpu.stack
+	cpu.ip, cpu.hlt, cpu.steps = state.IP, state.Halted, state.Steps
+	cpu.gas = gasMeter{table: state.GasTable, limit: state.GasLimit, used: state.GasUsed, limited: state.GasLimited}
+	if uint64(len(state.Stack)) > uint64(stack.depth) || state.Base > uint32(len(state.Stack)) {
+		return nil, fmt.Errorf("%w: bad stack of %d values", ErrSnapshotInvalid, len(state.Stack))
+	}
+	stack.reserve(uint32(len(state.Stack)))
+	copy(stack.data, state.Stack)
+	stack.index, stack.baseIndex, stack.calls = uint32(len(state.Stack)), state.Base, state.Calls
+	vm.heap.free = pairBlocks(state.HeapFree)
+	vm.heap.live = pairBlocks(state.HeapLive)
+	vm.heap.freed = pairBlocks(state.HeapFreed)
+	vm.heap.stats = state.HeapStats
+	if !vm.heap.valid() {
+		return nil, fmt.Errorf("%w: heap blocks outside the heap or overlapping", ErrSnapshotInvalid)
+	}
+	vm.random = splitMix(state.Random)
+	return vm, nil
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func blockPairs(blocks []block) [][2]uint64 {
+	pairs := make([][2]uint64, len(blocks))
+	for i, b := range blocks {
+		pairs[i] = [2]uint64{b.start, b.size}
+	}
+	return pairs
+}
+
+func pairBlocks(pairs [][2]uint64) []block {
+	blocks := make([]block, len(pairs))
+	for i, pair := range pairs {
+		blocks[i] = block{start: pair[0], size: pair[1]}
+	}
+	return blocks
+}
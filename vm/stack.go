@@ -1,22 +1,53 @@
 package vm
 
-import (
-	"fmt"
-)
-
+// MAX_DEPTH is the default stack depth
 const MAX_DEPTH = 20000
 
+// initialGrowableSize is the number of values allocated at first by a
+// growable stack
+const initialGrowableSize = 256
+
 type Stack struct {
-	data      [MAX_DEPTH]uint64
+	data      []uint64
 	index     uint32
 	baseIndex uint32
+	depth     uint32 // Limit of index
+	growable  bool   // data grows on demand up to depth
+	calls     uint32 // Number of active call frames
+	maxCalls  uint32 // 0 means no limit
 }
 
 func MakeStack() *Stack {
-	stack := Stack{index: 0, baseIndex: 0}
+	return makeStack(MAX_DEPTH, false, 0)
+}
+
+// makeStack allocates depth values, or fewer when growable
+func makeStack(depth uint32, growable bool, maxCalls uint32) *Stack {
+	size := depth
+	if growable && size > initialGrowableSize {
+		size = initialGrowableSize
+	}
+	stack := Stack{data: make([]uint64, size), depth: depth, growable: growable, maxCalls: maxCalls}
 	return &stack
 }
 
+// reserve makes room for n values, n is at most depth
+func (stack *Stack) reserve(n uint32) {
+	if n <= uint32(len(stack.data)) {
+		return
+	}
+	size := uint32(len(stack.data)) * 2
+	if size < n {
+		size = n
+	}
+	if size > stack.depth {
+		size = stack.depth
+	}
+	data := make([]uint64, size)
+	copy(data, stack.data[:stack.index])
+	stack.data = data
+}
+
 func (stack *Stack) Empty() bool {
 	return stack.index == 0
 }
@@ -25,63 +56,104 @@ func (stack *Stack) Reset() {
 	stack.index = 0
 }
 
-func (stack *Stack) Push(value uint64) {
-
-	if stack.index < MAX_DEPTH-1 {
+func (stack *Stack) Push(value uint64) error {
+	if stack.index < stack.depth {
+		stack.reserve(stack.index + 1)
 		stack.data[stack.index] = value
 		stack.index++
-	} else {
-		fmt.Println("Err: ", stack.index, MAX_DEPTH)
-		panic("Push run out of stack")
+		return nil
 	}
+	return &Fault{Kind: StackOverflow}
 }
 
-func (stack *Stack) Top() uint64 {
-	return stack.data[stack.index-1]
+func (stack *Stack) Top() (uint64, error) {
+	if stack.index > stack.baseIndex {
+		return stack.data[stack.index-1], nil
+	}
+	return 0, &Fault{Kind: StackUnderflow}
 }
 
-func (stack *Stack) Pop() uint64 {
+func (stack *Stack) Pop() (uint64, error) {
 	if stack.index > stack.baseIndex {
 		result := stack.data[stack.index-1]
 		stack.index -= 1
-		return result
-	} else {
-		panic("Exceed stack bottom, cannot pop more")
+		return result, nil
+	}
+	return 0, &Fault{Kind: StackUnderflow}
+}
+
+// Load reads slot of the current call frame, slot 0 is the first parameter
+func (stack *Stack) Load(slot uint64) (uint64, error) {
+	if slot >= uint64(stack.index-stack.baseIndex) {
+		return 0, &Fault{Kind: BadCallFrame}
 	}
+	return stack.data[stack.baseIndex+uint32(slot)], nil
 }
 
-func (stack *Stack) SetupCall(retPC uint64) {
-	numParams := stack.data[stack.index-1]
-	if stack.index-stack.baseIndex < uint32(numParams)+1 {
-		panic("Invalid function call")
+// Store overwrites slot of the current call frame
+func (stack *Stack) Store(slot uint64, value uint64) error {
+	if slot >= uint64(stack.index-stack.baseIndex) {
+		return &Fault{Kind: BadCallFrame}
+	}
+	stack.data[stack.baseIndex+uint32(slot)] = value
+	return nil
+}
+
+func (stack *Stack) SetupCall(retPC uint64) error {
+	numParams, err := stack.Top()
+	if err != nil {
+		return err
+	}
+	if stack.maxCalls != 0 && stack.calls >= stack.maxCalls {
+		return &Fault{Kind: CallDepthExceeded}
+	}
+	// The count itself is in the frame, compared without adding to numParams
+	// as any value can be on the stack
+	if numParams >= uint64(stack.index-stack.baseIndex) {
+		return &Fault{Kind: BadCallFrame}
 	}
 	// calldata := stack.data[stack.index-1-uint32(numParams) : stack.index-1]
-	stack.Push(retPC)
-	stack.Push(uint64(stack.baseIndex))
-	stack.baseIndex = stack.index
-	if stack.baseIndex+uint32(numParams) < MAX_DEPTH {
-		stack.index = stack.baseIndex + uint32(numParams)
-		copy(stack.data[stack.baseIndex:stack.baseIndex+uint32(numParams)], stack.data[stack.baseIndex-3-uint32(numParams):stack.baseIndex-3])
-	} else {
-		panic("Setup call run out of stack")
+	if err := stack.Push(retPC); err != nil {
+		return err
+	}
+	if err := stack.Push(uint64(stack.baseIndex)); err != nil {
+		return err
 	}
+	if numParams > uint64(stack.depth-stack.index) {
+		return &Fault{Kind: StackOverflow}
+	}
+	stack.reserve(stack.index + uint32(numParams))
+	stack.calls++
+	stack.baseIndex = stack.index
+	stack.index = stack.baseIndex + uint32(numParams)
+	copy(stack.data[stack.baseIndex:stack.baseIndex+uint32(numParams)], stack.data[stack.baseIndex-3-uint32(numParams):stack.baseIndex-3])
 	// fmt.Println("Setup calldata", calldata, stack.baseIndex, stack.index, stack.data[stack.baseIndex:stack.baseIndex+uint32(numParams)])
+	return nil
 }
 
-func (stack *Stack) SetupReturn() uint64 {
+func (stack *Stack) SetupReturn() (uint64, error) {
 	// fmt.Println("Stack value", stack.data[:stack.index], stack.baseIndex, stack.index)
+	if stack.baseIndex < 3 {
+		return 0, &Fault{Kind: BadCallFrame}
+	}
 	var retValue uint64 = 0
 	hasRet := stack.index > stack.baseIndex
 	if hasRet {
-		retValue = stack.Top()
+		retValue = stack.data[stack.index-1]
 	}
 	baseIndex := stack.data[stack.baseIndex-1]
 	pc := stack.data[stack.baseIndex-2]
 	numParams := stack.data[stack.baseIndex-3]
+	if numParams > uint64(stack.baseIndex-3) || baseIndex > uint64(stack.baseIndex) {
+		return 0, &Fault{Kind: BadCallFrame}
+	}
 	stack.index = stack.baseIndex - 3 - uint32(numParams)
 	stack.baseIndex = uint32(baseIndex)
+	if stack.calls > 0 {
+		stack.calls--
+	}
 	if hasRet {
-		stack.Push(retValue)
+		return pc, stack.Push(retValue)
 	}
-	return pc
+	return pc, nil
 }
@@ -0,0 +1,168 @@
+package vm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"strconv"
+)
+
+// Syscall is a host function called by the SYSCALL instruction. It pops its
+// arguments from the stack of cpu and pushes its results. An error that is
+// not a *Fault is returned as is by Run and halts the CPU.
+type Syscall func(cpu *CPU) error
+
+// Services registered by every VM. Arguments are pushed in order, so the
+// last one is on top of the stack.
+const (
+	SysWriteByte uint64 = 1 // (byte) writes a byte to stdout
+	SysWriteInt  uint64 = 2 // (n) writes n as a signed decimal number
+	SysWriteUint uint64 = 3 // (n) writes n as an unsigned decimal number
+	SysWrite     uint64 = 4 // (offset, size) writes size bytes of the data segment
+	SysReadByte  uint64 = 5 // () -> byte read from stdin, or -1 at the end of input
+	SysRead      uint64 = 6 // (offset, size) -> number of bytes read into the data segment, 0 at the end of input
+)
+
+// RegisterSyscall makes SYSCALL service call fn, a nil fn removes the service
+func (vm *VM) RegisterSyscall(service uint64, fn Syscall) {
+	if fn == nil {
+		delete(vm.syscalls, service)
+		return
+	}
+	vm.syscalls[service] = fn
+}
+
+// SetStdio replaces the standard input and output of the default services
+func (vm *VM) SetStdio(in io.Reader, out io.Writer) {
+	vm.stdin = bufio.NewReader(in)
+	vm.stdout = out
+}
+
+func (vm *VM) registerDefaultSyscalls() {
+	vm.syscalls = make(map[uint64]Syscall)
+	vm.SetStdio(os.Stdin, os.Stdout)
+	vm.RegisterSyscall(SysWriteByte, sysWriteByte)
+	vm.RegisterSyscall(SysWriteInt, sysWriteInt)
+	vm.RegisterSyscall(SysWriteUint, sysWriteUint)
+	vm.RegisterSyscall(SysWrite, sysWrite)
+	vm.RegisterSyscall(SysReadByte, sysReadByte)
+	vm.RegisterSyscall(SysRead, sysRead)
+}
+
+func (cpu *CPU) processSYSCALL(service uint64) error {
+	fn, ok := cpu.vm.syscalls[service]
+	if !ok {
+		return &Fault{Kind: UnknownSyscall}
+	}
+	return fn(cpu)
+}
+
+// VM returns the machine of the CPU, for syscalls that access its memory
+func (cpu *CPU) VM() *VM {
+	return cpu.vm
+}
+
+// Push pushes value on the stack
+func (cpu *CPU) Push(value uint64) error {
+	return cpu.stack.Push(value)
+}
+
+// Pop removes the value on top of the stack
+func (cpu *CPU) Pop() (uint64, error) {
+	return cpu.stack.Pop()
+}
+
+// WriteData copies data to offset in the data segment
+func (vm *VM) WriteData(offset uint64, data []byte) error {
+	index, err := vm.cpu.dataAddress(offset, uint64(len(data)), PermWrite)
+	if err != nil {
+		return err
+	}
+	copy(vm.memory[index:], data)
+	return nil
+}
+
+func sysWriteByte(cpu *CPU) error {
+	value, err := cpu.Pop()
+	if err != nil {
+		return err
+	}
+	_, err = cpu.vm.stdout.Write([]byte{byte(value)})
+	return err
+}
+
+func sysWriteInt(cpu *CPU) error {
+	value, err := cpu.Pop()
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(cpu.vm.stdout, strconv.FormatInt(int64(value), 10))
+	return err
+}
+
+func sysWriteUint(cpu *CPU) error {
+	value, err := cpu.Pop()
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(cpu.vm.stdout, strconv.FormatUint(value, 10))
+	return err
+}
+
+func sysWrite(cpu *CPU) error {
+	offset, size, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	index, err := cpu.heapAddress(offset, size, PermRead)
+	if err != nil {
+		return err
+	}
+	data := cpu.vm.memory[index : index+size]
+	if cpu.observed() {
+		cpu.access(WatchRead, offset, size, firstWord(data), firstWord(data))
+	}
+	_, err = cpu.vm.stdout.Write(data)
+	return err
+}
+
+func sysReadByte(cpu *CPU) error {
+	value, err := cpu.vm.stdin.ReadByte()
+	if err == io.EOF {
+		return cpu.Push(1<<64 - 1)
+	}
+	if err != nil {
+		return err
+	}
+	return cpu.Push(uint64(value))
+}
+
+func sysRead(cpu *CPU) error {
+	offset, size, err := cpu.popPair()
+	if err != nil {
+		return err
+	}
+	index, err := cpu.heapAddress(offset, size, PermWrite)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, size)
+	n, err := cpu.vm.stdin.Read(data)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if cpu.observed() && n > 0 {
+		cpu.access(WatchWrite, offset, uint64(n), firstWord(cpu.vm.memory[index:index+uint64(n)]), firstWord(data[:n]))
+	}
+	copy(cpu.vm.memory[index:], data[:n])
+	return cpu.Push(uint64(n))
+}
+
+// firstWord is the little endian value of the first 8 bytes of a syscall
+// buffer, as watchpoints and the tracer report accesses by value
+func firstWord(data []byte) uint64 {
+	var word [8]byte
+	copy(word[:], data)
+	return binary.LittleEndian.Uint64(word[:])
+}
@@ -0,0 +1,100 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// TraceRecord is written by the tracer for every traced instruction
+type TraceRecord struct {
+	Step    uint64         `json:"step"`
+	IP      uint64         `json:"ip"`
+	Op      string         `json:"op"`
+	Operand *uint64        `json:"operand,omitempty"`
+	Depth   uint32         `json:"depth"`         // Stack depth after the instruction
+	Base    uint32         `json:"base"`          // Frame base after the instruction
+	Stack   []uint64       `json:"stack"`         // Topmost values after the instruction, top first
+	Memory  []MemoryEffect `json:"mem,omitempty"` // Data segment accesses
+	Fault   string         `json:"fault,omitempty"`
+}
+
+// MemoryEffect is one data segment access of a traced instruction
+type MemoryEffect struct {
+	Access string `json:"access"`
+	Offset uint64 `json:"offset"`
+	Size   uint64 `json:"size"`
+	Value  uint64 `json:"value"` // Value read or written
+}
+
+// Tracer writes executed instructions to a writer as JSON lines. Only the
+// instructions with From <= IP < To are traced, and of those only one every
+// Sample steps.
+type Tracer struct {
+	Sample      uint64 // Trace one step out of Sample, 0 and 1 trace all
+	From        uint64
+	To          uint64 // 0 means no upper bound
+	StackValues int    // Number of stack values per record
+	encoder     *json.Encoder
+	err         error
+}
+
+// NewTracer traces every instruction with the top 4 stack values
+func NewTracer(w io.Writer) *Tracer {
+	return &Tracer{StackValues: 4, encoder: json.NewEncoder(w)}
+}
+
+// Err returns the first write error, tracing stops after it
+func (tracer *Tracer) Err() error {
+	return tracer.err
+}
+
+// SetTracer starts tracing with tracer, nil stops tracing
+func (vm *VM) SetTracer(tracer *Tracer) {
+	vm.cpu.tracer = tracer
+}
+
+func (tracer *Tracer) wants(step uint64, ip uint64) bool {
+	if tracer.err != nil || ip < tracer.From || (tracer.To != 0 && ip >= tracer.To) {
+		return false
+	}
+	return tracer.Sample <= 1 || step%tracer.Sample == 0
+}
+
+func (tracer *Tracer) begin(cpu *CPU, ip uint64) {
+	if !tracer.wants(cpu.steps, ip) {
+		return
+	}
+	record := &TraceRecord{Step: cpu.steps, IP: ip}
+	if ip < uint64(len(cpu.vm.memory)/8) {
+		opcode, operand := Decode(cpu.vm.LoadInstruction(ip))
+		info, ok := LookupOpcode(opcode)
+		switch {
+		case !ok:
+			record.Op = fmt.Sprintf("0x%02x", opcode)
+		case info.Wide && ip+1 < uint64(len(cpu.vm.memory)/8):
+			immediate := cpu.vm.LoadInstruction(ip + 1)
+			record.Op, record.Operand = info.Name, &immediate
+		case info.Operand:
+			record.Op, record.Operand = info.Name, &operand
+		default:
+			record.Op = info.Name
+		}
+	}
+	cpu.record = record
+}
+
+func (tracer *Tracer) end(cpu *CPU, err error) {
+	record := cpu.record
+	cpu.record = nil
+	stack := cpu.stack
+	record.Depth, record.Base = stack.index, stack.baseIndex
+	record.Stack = make([]uint64, 0, tracer.StackValues)
+	for i := stack.index; i > 0 && len(record.Stack) < tracer.StackValues; i-- {
+		record.Stack = append(record.Stack, stack.data[i-1])
+	}
+	if err != nil {
+		record.Fault = err.Error()
+	}
+	tracer.err = tracer.encoder.Encode(record)
+}
@@ -0,0 +1,334 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Diagnostic is a problem found by Verify in the instruction at Index
+type Diagnostic struct {
+	Index   uint64
+	Message string
+}
+
+func (diagnostic Diagnostic) String() string {
+	return fmt.Sprintf("%d: %s", diagnostic.Index, diagnostic.Message)
+}
+
+// VerifyError is returned by RunContext when Config.Verify is set and the
+// ROM does not pass Verify
+type VerifyError struct {
+	Diagnostics []Diagnostic
+}
+
+func (err *VerifyError) Error() string {
+	msg := fmt.Sprintf("rom failed verification at %s", err.Diagnostics[0])
+	if len(err.Diagnostics) > 1 {
+		msg += fmt.Sprintf(" and %d more", len(err.Diagnostics)-1)
+	}
+	return msg
+}
+
+// Stack effects of the default syscalls as {pops, pushes}
+var syscallEffects = map[uint64][2]int{
+	SysWriteByte: {1, 0},
+	SysWriteInt:  {1, 0},
+	SysWriteUint: {1, 0},
+	SysWrite:     {2, 0},
+	SysReadByte:  {0, 1},
+	SysRead:      {2, 1},
+}
+
+// Verify checks rom, run from entry, before it is executed. It reports
+// unknown opcodes, CALL and constant jump targets that are not instructions
+// of rom, paths that fall off the end of rom without HLT, and stack
+// underflows and height mismatches at merges wherever the height of the call
+// frame is known statically. Jumps are followed when their destination is
+// pushed by a constant, SYSCALL is assumed to call the default services. The
+// diagnostics are sorted by index.
+func Verify(rom []uint64, entry uint64) []Diagnostic {
+	v := verifier{
+		rom:     rom,
+		entry:   entry,
+		starts:  make([]bool, len(rom)),
+		seen:    make([]bool, len(rom)),
+		states:  make([]frameState, len(rom)),
+		owners:  make([]uint64, len(rom)),
+		results: make(map[uint64]int),
+		sites:   make(map[uint64][]callSite),
+		found:   make(map[Diagnostic]bool),
+	}
+	v.decode()
+	if entry >= uint64(len(rom)) || !v.starts[entry] {
+		v.report(entry, "entry %d is not an instruction", entry)
+	} else {
+		v.merge(entry, frameState{}, entry, false)
+		v.run()
+	}
+	sort.SliceStable(v.diagnostics, func(i, j int) bool {
+		return v.diagnostics[i].Index < v.diagnostics[j].Index
+	})
+	return v.diagnostics
+}
+
+// heightUnknown is the height of frames that differ between paths or depend
+// on values computed at run time
+const heightUnknown = -1
+
+// noOwner is the owner of instructions shared by several functions
+const noOwner = ^uint64(0)
+
+// frameState is what Verify knows of the call frame before an instruction
+type frameState struct {
+	height   int // Number of values in the frame, or heightUnknown
+	top      uint64
+	constant bool // The value on top is top
+}
+
+// callSite is a CALL waiting for the result of its callee
+type callSite struct {
+	next   uint64 // Index following the CALL
+	owner  uint64
+	height int // Height of the caller frame once the parameters are gone
+}
+
+type verifier struct {
+	rom         []uint64
+	entry       uint64
+	starts      []bool // Instructions start there, rather than PUSH64 immediates
+	seen        []bool
+	states      []frameState
+	owners      []uint64              // Entry of the function executing the instruction
+	results     map[uint64]int        // Values pushed back by the RETs of a function once one is reached
+	sites       map[uint64][]callSite // Callers of a function
+	calls       map[uint64]bool       // Targets of CALL
+	work        []uint64
+	diagnostics []Diagnostic
+	found       map[Diagnostic]bool
+}
+
+func (v *verifier) report(index uint64, format string, args ...interface{}) {
+	diagnostic := Diagnostic{Index: index, Message: fmt.Sprintf(format, args...)}
+	if !v.found[diagnostic] {
+		v.found[diagnostic] = true
+		v.diagnostics = append(v.diagnostics, diagnostic)
+	}
+}
+
+// decode goes through rom once to find where instructions start and checks
+// what does not depend on the path
+func (v *verifier) decode() {
+	v.calls = make(map[uint64]bool)
+	for i := 0; i < len(v.rom); {
+		opcode, operand := Decode(v.rom[i])
+		info, ok := LookupOpcode(opcode)
+		v.starts[i] = true
+		if !ok {
+			v.report(uint64(i), "unknown opcode 0x%02x", opcode)
+			i++
+			continue
+		}
+		if opcode == CALL {
+			v.calls[operand] = true
+		}
+		if info.Wide && i+1 == len(v.rom) {
+			v.report(uint64(i), "%s without its immediate word", info.Name)
+		}
+		i += info.Words()
+	}
+	for i, start := range v.starts {
+		opcode, operand := Decode(v.rom[i])
+		if start && opcode == CALL && !v.isInstruction(operand) {
+			v.report(uint64(i), "CALL target %d is not an instruction", operand)
+		}
+	}
+}
+
+func (v *verifier) isInstruction(index uint64) bool {
+	return index < uint64(len(v.rom)) && v.starts[index]
+}
+
+// merge joins state into what is known before the instruction at index and
+// queues it when that changes. Call entries take the height of every
+// caller, differing heights are only reported for other merges.
+func (v *verifier) merge(index uint64, state frameState, owner uint64, call bool) {
+	if !v.seen[index] {
+		v.seen[index] = true
+		v.states[index] = state
+		v.owners[index] = owner
+		v.work = append(v.work, index)
+		return
+	}
+	old := v.states[index]
+	joined := old
+	if old.height != state.height {
+		if old.height != heightUnknown && state.height != heightUnknown && !call {
+			v.report(index, "stack height %d differs from %d on another path", state.height, old.height)
+		}
+		joined.height = heightUnknown
+	}
+	if !state.constant || !old.constant || state.top != old.top {
+		joined.constant = false
+	}
+	changed := joined != old
+	if v.owners[index] != owner && v.owners[index] != noOwner {
+		v.owners[index] = noOwner
+		changed = true
+	}
+	if changed {
+		v.states[index] = joined
+		v.work = append(v.work, index)
+	}
+}
+
+// run follows the paths from the queued instructions until nothing changes
+func (v *verifier) run() {
+	for len(v.work) > 0 {
+		index := v.work[len(v.work)-1]
+		v.work = v.work[:len(v.work)-1]
+		v.step(index)
+	}
+}
+
+// step applies the instruction at index to its state and merges the result
+// into its successors
+func (v *verifier) step(index uint64) {
+	state, owner := v.states[index], v.owners[index]
+	opcode, operand := Decode(v.rom[index])
+	info, ok := LookupOpcode(opcode)
+	if !ok {
+		return
+	}
+	next := index + uint64(info.Words())
+	pops, pushes := info.Pops, info.Pushes
+	if opcode == SYSCALL {
+		effect, known := syscallEffects[operand]
+		if !known {
+			v.fallThrough(index, next, frameState{height: heightUnknown}, owner)
+			return
+		}
+		pops, pushes = effect[0], effect[1]
+	}
+	if state.height != heightUnknown && state.height < pops {
+		v.report(index, "stack underflow, %s needs %d and the frame holds %d", info.Name, pops, state.height)
+		return
+	}
+	after := frameState{height: heightUnknown}
+	if state.height != heightUnknown {
+		after.height = state.height - pops + pushes
+	}
+	switch {
+	case opcode == PUSH || opcode == PUSHF:
+		after.top, after.constant = operand, true
+		if opcode == PUSHF {
+			after.top = operand << 8
+		}
+	case opcode == PUSH64 && next <= uint64(len(v.rom)):
+		after.top, after.constant = v.rom[index+1], true
+	case opcode == DUP:
+		after.top, after.constant = state.top, state.constant
+	}
+
+	switch {
+	case opcode == HLT:
+	case opcode == RET:
+		v.ret(index, state, owner)
+	case opcode == CALL:
+		v.call(index, operand, state, owner)
+	case info.Jump:
+		if state.constant {
+			if v.isInstruction(state.top) {
+				v.merge(state.top, after, owner, false)
+			} else {
+				v.report(index, "%s target %d is not an instruction", info.Name, state.top)
+			}
+		}
+		if opcode != JMP {
+			v.fallThrough(index, next, after, owner)
+		}
+	default:
+		v.fallThrough(index, next, after, owner)
+	}
+}
+
+func (v *verifier) fallThrough(index uint64, next uint64, state frameState, owner uint64) {
+	if next >= uint64(len(v.rom)) {
+		v.report(index, "falls off the end of the rom without HLT")
+		return
+	}
+	v.merge(next, state, owner, false)
+}
+
+// call enters the callee with the parameters counted by the constant on top
+// of the stack, execution resumes after the CALL once the result of the
+// callee is known
+func (v *verifier) call(index uint64, target uint64, state frameState, owner uint64) {
+	if !v.isInstruction(target) {
+		return
+	}
+	site := callSite{next: index + 1, owner: owner, height: heightUnknown}
+	callee := frameState{height: heightUnknown}
+	if state.constant {
+		params := state.top
+		if state.height != heightUnknown {
+			if uint64(state.height) < params+1 {
+				v.report(index, "CALL passes %d parameters, the frame holds %d values", params, state.height-1)
+				return
+			}
+			site.height = state.height - 1 - int(params)
+		}
+		if params <= math.MaxInt32 {
+			callee.height = int(params)
+		}
+	}
+	v.merge(target, callee, target, true)
+	if site.next >= uint64(len(v.rom)) {
+		v.report(index, "falls off the end of the rom without HLT")
+		return
+	}
+	v.sites[target] = append(v.sites[target], site)
+	if result, ok := v.results[target]; ok {
+		v.resume(site, result)
+	}
+}
+
+// ret records whether the function of the RET leaves a result and resumes
+// its callers
+func (v *verifier) ret(index uint64, state frameState, owner uint64) {
+	if owner == v.entry && !v.calls[v.entry] {
+		v.report(index, "RET outside of a function")
+		return
+	}
+	if owner == noOwner {
+		return
+	}
+	result := heightUnknown
+	if state.height != heightUnknown {
+		result = 0
+		if state.height > 0 {
+			result = 1
+		}
+	}
+	if old, ok := v.results[owner]; ok {
+		if old == result || old == heightUnknown {
+			return
+		}
+		if result != heightUnknown {
+			v.report(index, "RET leaves %d results, another RET of the function at %d leaves %d", result, owner, old)
+		}
+		result = heightUnknown
+	}
+	v.results[owner] = result
+	for _, site := range v.sites[owner] {
+		v.resume(site, result)
+	}
+}
+
+func (v *verifier) resume(site callSite, result int) {
+	state := frameState{height: heightUnknown}
+	if site.height != heightUnknown && result != heightUnknown {
+		state.height = site.height + result
+	}
+	v.merge(site.next, state, site.owner, false)
+}
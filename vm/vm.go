@@ -1,47 +1,231 @@
 package vm
 
-import "fmt"
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+)
 
-var (
+// Default layout of the memory of a VM
+const (
 	defaulRomSize   uint32 = 50000 * 8 // Each instruction takes 8 bytes
 	codeSegmentSize uint32 = 550000 * 8
 	dataSegmentSize uint32 = 16000000
 )
 
+// Config describes the memory of a VM. Memory starts with the ROM, followed
+// by the code segment and the data segment, the heap takes the last
+// HeapSize bytes of the data segment.
+type Config struct {
+	MemorySize      uint32 // 0 means the sum of the segment sizes
+	RomSize         uint32 // Multiple of 8, each instruction takes 8 bytes
+	CodeSegmentSize uint32 // Multiple of 8
+	DataSegmentSize uint32
+	StackDepth      uint32 // Maximum number of values on the stack
+	GrowableStack   bool   // Allocate the stack on demand rather than up front
+	CallDepth       uint32 // Maximum number of nested CALLs, 0 means no limit
+	HeapSize        uint32
+	HeapDebug       bool // Detect double frees and uses after free, freed blocks are not reused
+	Deterministic   bool // Use DeterministicClock and DeterministicSeed by default
+	Verify          bool // Run Verify on the ROM before running it
+}
+
+// DefaultConfig is the layout of the VMs made by MakeVM
+func DefaultConfig() Config {
+	return Config{
+		RomSize:         defaulRomSize,
+		CodeSegmentSize: codeSegmentSize,
+		DataSegmentSize: dataSegmentSize,
+		StackDepth:      MAX_DEPTH,
+	}
+}
+
+// maxStackDepth keeps the stack within 4GB, like the memory
+const maxStackDepth = 1 << 29
+
+// ErrInvalidConfig is wrapped by the errors of NewVM
+var ErrInvalidConfig = errors.New("invalid VM config")
+
+// validate fills in MemorySize and checks the constraints of the layout
+func (config *Config) validate() error {
+	segments := uint64(config.RomSize) + uint64(config.CodeSegmentSize) + uint64(config.DataSegmentSize)
+	switch {
+	case config.RomSize == 0 || config.RomSize%8 != 0:
+		return fmt.Errorf("%w: ROM size %d is not a positive multiple of 8", ErrInvalidConfig, config.RomSize)
+	case config.CodeSegmentSize%8 != 0:
+		return fmt.Errorf("%w: code segment size %d is not a multiple of 8", ErrInvalidConfig, config.CodeSegmentSize)
+	case segments > 1<<32-1:
+		return fmt.Errorf("%w: segments of %d bytes exceed 4GB", ErrInvalidConfig, segments)
+	case config.StackDepth == 0:
+		return fmt.Errorf("%w: stack depth is 0", ErrInvalidConfig)
+	case config.StackDepth > maxStackDepth:
+		return fmt.Errorf("%w: stack depth %d exceeds %d values", ErrInvalidConfig, config.StackDepth, maxStackDepth)
+	case config.HeapSize > config.DataSegmentSize:
+		return fmt.Errorf("%w: heap size %d exceeds the data segment size %d", ErrInvalidConfig, config.HeapSize, config.DataSegmentSize)
+	}
+	if config.MemorySize == 0 {
+		config.MemorySize = uint32(segments)
+	}
+	if uint64(config.MemorySize) < segments {
+		return fmt.Errorf("%w: memory size %d is too small for ROM %d, code segment %d and data segment %d bytes",
+			ErrInvalidConfig, config.MemorySize, config.RomSize, config.CodeSegmentSize, config.DataSegmentSize)
+	}
+	return nil
+}
+
 type VM struct {
-	memory []uint8
-	rom    []uint64
-	cpu    *CPU
+	config      Config
+	segments    []Segment
+	memory      []uint8
+	rom         []uint64
+	cpu         *CPU
+	watchpoints []watchEntry
+	nextWatchID int
+	heap        heap
+	syscalls    map[uint64]Syscall
+	stdin       *bufio.Reader
+	stdout      io.Writer
+	clock       Clock
+	rand        *rand.Rand
+	random      splitMix // Source of rand
 }
 
+// MakeVM makes a VM with the default layout, it returns nil when memorySize
+// is too small for it. Use NewVM to learn why.
 func MakeVM(memorySize uint32) *VM {
-	if memorySize >= defaulRomSize+codeSegmentSize+dataSegmentSize {
-		vm := &VM{memory: make([]uint8, memorySize), rom: make([]uint64, 0)}
-		cpu := MakeCPU(vm)
-		vm.cpu = cpu
-		return vm
+	config := DefaultConfig()
+	config.MemorySize = memorySize
+	vm, err := NewVM(config)
+	if err != nil {
+		return nil
 	}
-	return nil
+	return vm
+}
+
+// NewVM makes a VM with the layout of config
+func NewVM(config Config) (*VM, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	vm := &VM{config: config, segments: makeSegments(config), memory: make([]uint8, config.MemorySize), rom: make([]uint64, 0)}
+	vm.cpu = MakeCPU(vm)
+	vm.heap = makeHeap(config)
+	vm.SetClock(nil)
+	vm.seedRandom()
+	vm.registerDefaultSyscalls()
+	return vm, nil
+}
+
+// Config returns the layout of the VM, MemorySize is always set
+func (vm *VM) Config() Config {
+	return vm.config
 }
 
-func (vm *VM) AddInstruction(instruction uint64) {
-	vm.rom = append(vm.rom, instruction)
-	// fmt.Println(len(vm.rom))
-	if len(vm.rom)*8 > int(defaulRomSize) {
-		panic("Exceed ROM size")
+// AddInstruction appends the words of one instruction, nothing is added when they do not fit
+func (vm *VM) AddInstruction(instruction ...uint64) error {
+	if (len(vm.rom)+len(instruction))*8 > int(vm.config.RomSize) {
+		return ErrRomFull
 	}
+	vm.rom = append(vm.rom, instruction...)
+	return nil
 }
 
-func (vm *VM) FlashRom(rom []uint64) {
+func (vm *VM) FlashRom(rom []uint64) error {
+	if len(rom)*8 > int(vm.config.RomSize) {
+		return ErrRomFull
+	}
 	vm.rom = rom
+	return nil
+}
+
+// StartVM loads the ROM and runs it, a misbehaving program is reported as a *Fault
+func (vm *VM) StartVM() error {
+	_, err := vm.RunContext(context.Background())
+	return err
 }
 
-func (vm *VM) StartVM() {
-	vm.loadRom()
-	vm.cpu.Run()
+// RunContext loads the ROM and runs it until it halts, faults or ctx is
+// done. The returned state tells where the program stopped.
+func (vm *VM) RunContext(ctx context.Context) (State, error) {
+	if err := vm.verify(); err != nil {
+		return vm.State(), err
+	}
+	vm.LoadRom()
+	err := vm.cpu.RunContext(ctx)
+	return vm.State(), err
+}
+
+// Continue resumes a program paused by a watchpoint or a done context
+// without loading the ROM again
+func (vm *VM) Continue(ctx context.Context) (State, error) {
+	err := vm.cpu.RunContext(ctx)
+	return vm.State(), err
+}
+
+// State describes the registers of the CPU
+type State struct {
+	IP      uint64
+	Halted  bool
+	Depth   uint32 // Number of values on the stack
+	Base    uint32 // Stack index of the current call frame
+	Calls   uint32 // Number of active call frames
+	GasUsed uint64
+	Steps   uint64 // Number of instructions executed
+}
+
+// State must not be called while the VM is running
+func (vm *VM) State() State {
+	cpu := vm.cpu
+	return State{IP: cpu.ip, Halted: cpu.hlt, Depth: cpu.stack.index, Base: cpu.stack.baseIndex, Calls: cpu.stack.calls, GasUsed: cpu.gas.used, Steps: cpu.steps}
 }
 
-func (vm *VM) loadRom() {
+// Step executes the instruction at IP of a program loaded with LoadRom
+func (vm *VM) Step() error {
+	if vm.cpu.hlt {
+		return ErrHalted
+	}
+	if err := vm.verify(); err != nil {
+		return err
+	}
+	return vm.cpu.step()
+}
+
+// verify runs Verify from the entry point when Config.Verify is set. Only a
+// program that has not started is checked, as Verify assumes an empty frame.
+func (vm *VM) verify() error {
+	if !vm.config.Verify || vm.cpu.steps > 0 {
+		return nil
+	}
+	if diagnostics := Verify(vm.rom, vm.cpu.ip); len(diagnostics) > 0 {
+		return &VerifyError{Diagnostics: diagnostics}
+	}
+	return nil
+}
+
+// Stack returns a copy of the values on the stack, the top is the last one
+func (vm *VM) Stack() []uint64 {
+	stack := vm.cpu.stack
+	values := make([]uint64, stack.index)
+	copy(values, stack.data[:stack.index])
+	return values
+}
+
+// ReadData returns a copy of size bytes at offset in the data segment
+func (vm *VM) ReadData(offset uint64, size uint64) ([]byte, error) {
+	index, err := vm.cpu.dataAddress(offset, size, PermRead)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	copy(data, vm.memory[index:index+size])
+	return data, nil
+}
+
+// LoadRom copies the ROM to the start of memory, StartVM does it before running
+func (vm *VM) LoadRom() {
 	for i := 0; i < len(vm.rom); i++ {
 		for j := 0; j < 8; j++ {
 			vm.memory[i*8+j] = 0xff & uint8(vm.rom[i]>>((7-j)*8))
@@ -50,7 +234,7 @@ func (vm *VM) loadRom() {
 }
 
 func (vm *VM) getDataSegment() uint32 {
-	return defaulRomSize + codeSegmentSize
+	return vm.config.RomSize + vm.config.CodeSegmentSize
 }
 
 func (vm *VM) LoadInstruction(index uint64) uint64 {
@@ -63,6 +247,15 @@ func (vm *VM) LoadInstruction(index uint64) uint64 {
 	return code
 }
 
+// ReadRom returns the program as it is loaded in the code region of memory
+func (vm *VM) ReadRom() []uint64 {
+	code := make([]uint64, len(vm.rom))
+	for i := range code {
+		code[i] = vm.LoadInstruction(uint64(i))
+	}
+	return code
+}
+
 func (vm *VM) DebugRom() {
 	for i := 0; i < len(vm.rom); i++ {
 		fmt.Printf(" %b", vm.rom[i])
@@ -78,7 +271,7 @@ func (vm *VM) DebugMemory() {
 
 func (vm *VM) DebugStack() {
 	fmt.Println()
-	for i := 0; i < 10; i++ {
+	for i := 0; i < 10 && i < len(vm.cpu.stack.data); i++ {
 		fmt.Printf(" %d", vm.cpu.stack.data[i])
 	}
 }
@@ -1,10 +1,17 @@
 package vm
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
-
-	"bou.ke/monkey"
 )
 
 type TestCase struct {
@@ -18,8 +25,17 @@ func MakeTestCase(t *testing.T) *TestCase {
 	return &TestCase{t: t, vm: MakeVM(8 * 10000000), stackValue: make(map[int]uint64), memoryValue: make(map[uint32]uint8)}
 }
 
-func (testCase *TestCase) AddStep(value uint64) {
-	testCase.vm.AddInstruction(value)
+// MakeTestCaseConfig runs the test case on a VM with the layout of config
+func MakeTestCaseConfig(t *testing.T, config Config) *TestCase {
+	vm, err := NewVM(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &TestCase{t: t, vm: vm, stackValue: make(map[int]uint64), memoryValue: make(map[uint32]uint8)}
+}
+
+func (testCase *TestCase) AddStep(value ...uint64) {
+	testCase.vm.AddInstruction(value...)
 }
 
 func (testCase *TestCase) AddStackTest(k int, v uint64) {
@@ -39,8 +55,10 @@ func (testCase *TestCase) UpdateMemoryAddress(k uint32, v uint8) {
 }
 
 func (testCase *TestCase) Assert() {
-	testCase.vm.StartVM()
 	t := testCase.t
+	if err := testCase.vm.StartVM(); err != nil {
+		t.Fatalf("Unexpected fault: %v", err)
+	}
 	stack := testCase.vm.cpu.stack
 	mem := testCase.vm.memory
 	for k, v := range testCase.stackValue {
@@ -56,6 +74,21 @@ func (testCase *TestCase) Assert() {
 	}
 }
 
+func (testCase *TestCase) AssertFault(kind FaultKind, ip uint64) {
+	t := testCase.t
+	err := testCase.vm.StartVM()
+	fault, ok := err.(*Fault)
+	if !ok {
+		t.Fatalf("Expected %s fault, got %v", kind, err)
+	}
+	if fault.Kind != kind || fault.IP != ip {
+		t.Errorf("Fault %s at ip %d, expected %s at ip %d", fault.Kind, fault.IP, kind, ip)
+	}
+	if !testCase.vm.cpu.hlt {
+		t.Errorf("CPU keeps running after fault")
+	}
+}
+
 func TestAdd(t *testing.T) {
 	testCase := MakeTestCase(t)
 	testCase.AddStep(MakePUSH(5))
@@ -457,16 +490,40 @@ func TestJGE_EQUAL(t *testing.T) {
 }
 
 func TestTIME(t *testing.T) {
-	Now := func() time.Time {
-		return time.Date(2023, 04, 30, 20, 0, 0, 0, time.UTC)
-	}
-	monkey.Patch(time.Now, Now)
+	now := time.Date(2023, 04, 30, 20, 0, 0, 0, time.UTC)
 	testCase := MakeTestCase(t)
+	testCase.vm.SetClock(FixedClock{Time: now})
 	testCase.AddStep(MakePUSH(35))
 	testCase.AddStep(MakeTIME())
 	testCase.AddStackTest(0, 35)
-	testCase.AddStackTest(1, uint64(Now().UnixMilli()))
+	testCase.AddStackTest(1, uint64(now.UnixMilli()))
+	testCase.Assert()
+}
+
+func TestVirtualClock(t *testing.T) {
+	config := DefaultConfig()
+	config.Deterministic = true
+	testCase := MakeTestCaseConfig(t, config)
+	testCase.AddStep(MakeTIME())
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakeTIME())
+	testCase.AddStackTest(0, 0)
+	testCase.AddStackTest(1, 1)
+	testCase.AddStackTest(2, 2)
+	testCase.Assert()
+
+	testCase = MakeTestCase(t)
+	testCase.vm.SetClock(VirtualClock{Start: time.UnixMilli(1000), Tick: 10 * time.Millisecond})
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakeTIME())
+	testCase.AddStackTest(1, 1010)
 	testCase.Assert()
+
+	first, _ := NewVM(config)
+	second, _ := NewVM(config)
+	if a, b := first.cpu.Rand().Uint64(), second.cpu.Rand().Uint64(); a != b {
+		t.Errorf("Deterministic VMs draw %x and %x", a, b)
+	}
 }
 
 func TestSPACE(t *testing.T) {
@@ -584,3 +641,1356 @@ func TestSumFrom1ToN(t *testing.T) {
 	testCase.AddMemoryTest(10, 0)
 	testCase.Assert()
 }
+
+func TestFaultStackUnderflow(t *testing.T) {
+	testCase := MakeTestCase(t)
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakeADD())
+	testCase.AssertFault(StackUnderflow, 1)
+}
+
+func TestFaultStackOverflow(t *testing.T) {
+	testCase := MakeTestCase(t)
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakeDUP())
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakeJMP())
+	testCase.AssertFault(StackOverflow, 2)
+	if testCase.vm.cpu.stack.index != MAX_DEPTH {
+		t.Errorf("Stack depth %d at overflow", testCase.vm.cpu.stack.index)
+	}
+}
+
+func TestFaultInvalidOpcode(t *testing.T) {
+	testCase := MakeTestCase(t)
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(0xff00000000000000)
+	testCase.AssertFault(InvalidOpcode, 1)
+
+	testCase = MakeTestCase(t)
+	testCase.AddStep(0)
+	testCase.AddStep(MakeHLT())
+	testCase.AssertFault(InvalidOpcode, 0)
+}
+
+func TestHaltPastRom(t *testing.T) {
+	testCase := MakeTestCase(t)
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakePUSH(2))
+	testCase.AddStackTest(1, 2)
+	testCase.Assert()
+	if testCase.vm.cpu.ip != 3 {
+		t.Errorf("Halted with ip %d, expected 3", testCase.vm.cpu.ip)
+	}
+}
+
+func TestFaultDivisionByZero(t *testing.T) {
+	testCase := MakeTestCase(t)
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakePUSH(0))
+	testCase.AddStep(MakeMOD())
+	testCase.AssertFault(DivisionByZero, 2)
+}
+
+func TestFaultMemoryOutOfBounds(t *testing.T) {
+	testCase := MakeTestCase(t)
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakePUSH(uint64(len(testCase.vm.memory)) - 4))
+	testCase.AddStep(MakeSTORE())
+	testCase.AssertFault(MemoryOutOfBounds, 2)
+}
+
+func TestFaultBadCallFrame(t *testing.T) {
+	testCase := MakeTestCase(t)
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakeRET())
+	testCase.AssertFault(BadCallFrame, 1)
+
+	testCase = MakeTestCase(t)
+	testCase.AddStep(MakePUSH(3)) // Claims 3 parameters but only 1 value below
+	testCase.AddStep(MakeCALL(3))
+	testCase.AddStep(MakeHLT())
+	testCase.AddStep(MakeRET())
+	testCase.AssertFault(BadCallFrame, 1)
+
+	testCase = MakeTestCase(t)
+	testCase.AddStep(MakePUSH(7))
+	testCase.AddStep(MakePUSH(0))
+	testCase.AddStep(MakeDEC()) // MaxUint64 parameters
+	testCase.AddStep(MakeCALL(5))
+	testCase.AddStep(MakeHLT())
+	testCase.AddStep(MakeRET())
+	testCase.AssertFault(BadCallFrame, 3)
+}
+
+func TestRomFull(t *testing.T) {
+	vm := MakeVM(8 * 10000000)
+	for i := 0; i < int(defaulRomSize/8); i++ {
+		if err := vm.AddInstruction(MakePUSH(1)); err != nil {
+			t.Fatalf("Instruction %d rejected: %v", i, err)
+		}
+	}
+	if err := vm.AddInstruction(MakeHLT()); err != ErrRomFull {
+		t.Errorf("Expected ErrRomFull, got %v", err)
+	}
+}
+
+func TestNAND(t *testing.T) {
+	testCase := MakeTestCase(t)
+	testCase.AddStep(MakePUSH(0b1100))
+	testCase.AddStep(MakePUSH(0b1010))
+	testCase.AddStep(MakeNAND())
+	testCase.AddStep(MakePUSH(0))
+	testCase.AddStep(MakePUSH(0))
+	testCase.AddStep(MakeNAND())
+	testCase.AddStackTest(0, 0xfffffffffffffff7)
+	testCase.AddStackTest(1, 0xffffffffffffffff)
+	testCase.Assert()
+}
+
+func TestPOW(t *testing.T) {
+	testCase := MakeTestCase(t)
+	testCase.AddStep(MakePUSH(3))
+	testCase.AddStep(MakePUSH(4))
+	testCase.AddStep(MakePOW())   // [81]
+	testCase.AddStep(MakePUSH(7)) // [81 7]
+	testCase.AddStep(MakePUSH(0))
+	testCase.AddStep(MakePOW())   // [81 1]
+	testCase.AddStep(MakePUSH(2)) // [81 1 2]
+	testCase.AddStep(MakePUSH(64))
+	testCase.AddStep(MakePOW())   // [81 1 0]
+	testCase.AddStep(MakePUSH(3)) // [81 1 0 3]
+	testCase.AddStep(MakePUSH(41))
+	testCase.AddStep(MakePOW()) // [81 1 0 3^41 mod 2^64]
+	testCase.AddStackTest(0, 81)
+	testCase.AddStackTest(1, 1)
+	testCase.AddStackTest(2, 0)
+	testCase.AddStackTest(3, 0xfa2a1cf67b5fb863)
+	testCase.Assert()
+}
+
+func TestIMUL(t *testing.T) {
+	testCase := MakeTestCase(t)
+	testCase.AddStep(MakePUSH(0))
+	testCase.AddStep(MakePUSH(6))
+	testCase.AddStep(MakeSUB()) // [-6]
+	testCase.AddStep(MakePUSH(7))
+	testCase.AddStep(MakeIMUL()) // [-42]
+	testCase.AddStep(MakeDUP())
+	testCase.AddStep(MakeIMUL()) // [1764]
+	testCase.AddStackTest(0, 1764)
+	testCase.Assert()
+
+	testCase = MakeTestCase(t)
+	testCase.AddStep(MakePUSH(0))
+	testCase.AddStep(MakePUSH(6))
+	testCase.AddStep(MakeSUB())
+	testCase.AddStep(MakePUSH(7))
+	testCase.AddStep(MakeIMUL())
+	testCase.AddStackTest(0, 0xffffffffffffffd6)
+	testCase.Assert()
+}
+
+func TestIDIV(t *testing.T) {
+	testCase := MakeTestCase(t)
+	testCase.AddStep(MakePUSH(0))
+	testCase.AddStep(MakePUSH(7))
+	testCase.AddStep(MakeSUB()) // [-7]
+	testCase.AddStep(MakePUSH(2))
+	testCase.AddStep(MakeIDIV())  // [-3]
+	testCase.AddStep(MakePUSH(0)) // [-3 0]
+	testCase.AddStep(MakePUSH(3))
+	testCase.AddStep(MakeSUB())  // [-3 -3]
+	testCase.AddStep(MakeIDIV()) // [1]
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakePUSH(63))
+	testCase.AddStep(MakeSHL()) // [1 MinInt64]
+	testCase.AddStep(MakePUSH(0))
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakeSUB())
+	testCase.AddStep(MakeIDIV()) // [1 MinInt64]
+	testCase.AddStackTest(0, 1)
+	testCase.AddStackTest(1, 0x8000000000000000)
+	testCase.Assert()
+
+	testCase = MakeTestCase(t)
+	testCase.AddStep(MakePUSH(0))
+	testCase.AddStep(MakePUSH(7))
+	testCase.AddStep(MakeSUB())
+	testCase.AddStep(MakePUSH(2))
+	testCase.AddStep(MakeIDIV())
+	testCase.AddStackTest(0, 0xfffffffffffffffd)
+	testCase.Assert()
+
+	testCase = MakeTestCase(t)
+	testCase.AddStep(MakePUSH(5))
+	testCase.AddStep(MakePUSH(0))
+	testCase.AddStep(MakeIDIV())
+	testCase.AssertFault(DivisionByZero, 2)
+}
+
+// Calculate (a - b) * a with a local variable
+func TestSLOAD_SSTORE(t *testing.T) {
+	var FUNCTION uint64 = 5
+	testCase := MakeTestCase(t)
+	testCase.AddStep(MakePUSH(10)) // a
+	testCase.AddStep(MakePUSH(4))  // b
+	testCase.AddStep(MakePUSH(2))
+	testCase.AddStep(MakeCALL(FUNCTION))
+	testCase.AddStep(MakeHLT())
+
+	testCase.AddStep(MakePUSH(0)) // [10 4 0] local at slot 2
+	testCase.AddStep(MakePUSH(0))
+	testCase.AddStep(MakeSLOAD()) // [10 4 0 10]
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakeSLOAD()) // [10 4 0 10 4]
+	testCase.AddStep(MakeSUB())
+	testCase.AddStep(MakePUSH(2))
+	testCase.AddStep(MakeSSTORE()) // [10 4 6]
+	testCase.AddStep(MakePUSH(2))
+	testCase.AddStep(MakeSLOAD())
+	testCase.AddStep(MakePUSH(0))
+	testCase.AddStep(MakeSLOAD()) // [10 4 6 6 10]
+	testCase.AddStep(MakeMUL())
+	testCase.AddStep(MakeRET())
+
+	testCase.AddStackTest(0, 60)
+	testCase.Assert()
+	if testCase.vm.cpu.stack.index != 1 {
+		t.Errorf("Stack depth %d after return, expected 1", testCase.vm.cpu.stack.index)
+	}
+}
+
+func TestSLOAD8_SSTORE8(t *testing.T) {
+	testCase := MakeTestCase(t)
+	testCase.AddStep(MakePUSH(0x00223344556677))
+	testCase.AddStep(MakePUSH(0xaa))
+	testCase.AddStep(MakePUSH(3))
+	testCase.AddStep(MakeSSTORE8())
+	testCase.AddStep(MakePUSH(5))
+	testCase.AddStep(MakeSLOAD8())
+	testCase.AddStackTest(0, 0x002233aa556677)
+	testCase.AddStackTest(1, 0x22)
+	testCase.Assert()
+}
+
+func TestSLOADOutsideFrame(t *testing.T) {
+	testCase := MakeTestCase(t)
+	testCase.AddStep(MakePUSH(7))
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakeSLOAD())
+	testCase.AssertFault(BadCallFrame, 2)
+}
+
+func TestSignedCompare(t *testing.T) {
+	testCase := MakeTestCase(t)
+	testCase.AddStep(MakePUSH(0))
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakeSUB()) // [-1]
+	testCase.AddStep(MakeDUP())
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakeSLT()) // [-1 1]
+	testCase.AddStep(MakeSWAP())
+	testCase.AddStep(MakeDUP())
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakeSGT()) // [1 -1 0]
+	testCase.AddStep(MakeSWAP())
+	testCase.AddStep(MakeDUP())
+	testCase.AddStep(MakeDUP())
+	testCase.AddStep(MakeSLE()) // [1 0 -1 1]
+	testCase.AddStep(MakeSWAP())
+	testCase.AddStep(MakePUSH(0))
+	testCase.AddStep(MakeSGE()) // [1 0 1 0]
+	testCase.AddStackTest(0, 1)
+	testCase.AddStackTest(1, 0)
+	testCase.AddStackTest(2, 1)
+	testCase.AddStackTest(3, 0)
+	testCase.Assert()
+}
+
+func TestSignedArithmetic(t *testing.T) {
+	testCase := MakeTestCase(t)
+	testCase.AddStep(MakePUSH(7))
+	testCase.AddStep(MakeNEG()) // [-7]
+	testCase.AddStep(MakeDUP())
+	testCase.AddStep(MakePUSH(2))
+	testCase.AddStep(MakeSDIV()) // [-7 -3]
+	testCase.AddStep(MakeSWAP())
+	testCase.AddStep(MakeDUP())
+	testCase.AddStep(MakePUSH(2))
+	testCase.AddStep(MakeSMOD()) // [-3 -7 -1]
+	testCase.AddStep(MakeSWAP())
+	testCase.AddStep(MakeDUP())
+	testCase.AddStep(MakeABS()) // [-3 -1 -7 7]
+	testCase.AddStep(MakeSWAP())
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakeSAR()) // [-3 -1 7 -4]
+	testCase.AddStackTest(0, 0xfffffffffffffffd)
+	testCase.AddStackTest(1, 0xffffffffffffffff)
+	testCase.AddStackTest(2, 7)
+	testCase.AddStackTest(3, 0xfffffffffffffffc)
+	testCase.Assert()
+
+	testCase = MakeTestCase(t)
+	testCase.AddStep(MakePUSH(5))
+	testCase.AddStep(MakePUSH(0))
+	testCase.AddStep(MakeSMOD())
+	testCase.AssertFault(DivisionByZero, 2)
+}
+
+func TestSEXT(t *testing.T) {
+	testCase := MakeTestCase(t)
+	testCase.AddStep(MakePUSH(0x1280))
+	testCase.AddStep(MakeSEXT8())
+	testCase.AddStep(MakePUSH(0x7fff))
+	testCase.AddStep(MakeSEXT16())
+	testCase.AddStep(MakePUSH(0xff80000000))
+	testCase.AddStep(MakeSEXT32())
+	testCase.AddStep(MakePUSH(0xfffffffe))
+	testCase.AddStep(MakeSEXT32())
+	testCase.AddStackTest(0, 0xffffffffffffff80)
+	testCase.AddStackTest(1, 0x7fff)
+	testCase.AddStackTest(2, 0xffffffff80000000)
+	testCase.AddStackTest(3, 0xfffffffffffffffe)
+	testCase.Assert()
+}
+
+func TestJSLT(t *testing.T) {
+	var FAILED_LABEL uint64 = 11
+	var PASSED_LABEL uint64 = 13
+	testCase := MakeTestCase(t)
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakeNEG())
+	testCase.AddStep(MakePUSH(FAILED_LABEL)) // 1 < -1 is false
+	testCase.AddStep(MakeJSLT())
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakeNEG())
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakePUSH(PASSED_LABEL)) // -1 < 1
+	testCase.AddStep(MakeJSLT())
+	testCase.AddStep(MakeHLT())
+	testCase.AddStep(MakePUSH(15)) // JMP to failed
+	testCase.AddStep(MakeHLT())
+	testCase.AddStep(MakePUSH(2023)) // JMP to PASS
+	testCase.AddStep(MakeHLT())
+	testCase.AddStackTest(0, 2023)
+	testCase.Assert()
+}
+
+func TestJSGT(t *testing.T) {
+	var FAILED_LABEL uint64 = 10
+	var PASSED_LABEL uint64 = 12
+	testCase := MakeTestCase(t)
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakeNEG())
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakePUSH(FAILED_LABEL)) // -1 > 1 is false
+	testCase.AddStep(MakeJSGT())
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakeNEG())
+	testCase.AddStep(MakePUSH(PASSED_LABEL)) // 1 > -1
+	testCase.AddStep(MakeJSGT())
+	testCase.AddStep(MakePUSH(15)) // JMP to failed
+	testCase.AddStep(MakeHLT())
+	testCase.AddStep(MakePUSH(2023)) // JMP to PASS
+	testCase.AddStep(MakeHLT())
+	testCase.AddStackTest(0, 2023)
+	testCase.Assert()
+}
+
+func TestJSLE(t *testing.T) {
+	var FAILED_LABEL uint64 = 10
+	var PASSED_LABEL uint64 = 12
+	testCase := MakeTestCase(t)
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakeNEG())
+	testCase.AddStep(MakePUSH(FAILED_LABEL)) // 1 <= -1 is false
+	testCase.AddStep(MakeJSLE())
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakeNEG())
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakePUSH(PASSED_LABEL)) // -1 <= 1
+	testCase.AddStep(MakeJSLE())
+	testCase.AddStep(MakePUSH(15)) // JMP to failed
+	testCase.AddStep(MakeHLT())
+	testCase.AddStep(MakePUSH(2023)) // JMP to PASS
+	testCase.AddStep(MakeHLT())
+	testCase.AddStackTest(0, 2023)
+	testCase.Assert()
+}
+
+func TestJSGE(t *testing.T) {
+	var FAILED_LABEL uint64 = 10
+	var PASSED_LABEL uint64 = 12
+	testCase := MakeTestCase(t)
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakeNEG())
+	testCase.AddStep(MakePUSH(0))
+	testCase.AddStep(MakePUSH(FAILED_LABEL)) // -1 >= 0 is false
+	testCase.AddStep(MakeJSGE())
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakeNEG())
+	testCase.AddStep(MakeDUP())
+	testCase.AddStep(MakePUSH(PASSED_LABEL)) // -1 >= -1
+	testCase.AddStep(MakeJSGE())
+	testCase.AddStep(MakePUSH(15)) // JMP to failed
+	testCase.AddStep(MakeHLT())
+	testCase.AddStep(MakePUSH(2023)) // JMP to PASS
+	testCase.AddStep(MakeHLT())
+	testCase.AddStackTest(0, 2023)
+	testCase.Assert()
+}
+
+func TestFloat(t *testing.T) {
+	testCase := MakeTestCase(t)
+	testCase.AddStep(MakePUSHF(1.5))
+	testCase.AddStep(MakePUSHF(2.25))
+	testCase.AddStep(MakeFADD()) // [3.75]
+	testCase.AddStep(MakePUSHF(0.5))
+	testCase.AddStep(MakeFMUL()) // [1.875]
+	testCase.AddStep(MakePUSHF(16))
+	testCase.AddStep(MakeFSQRT())
+	testCase.AddStep(MakeFNEG()) // [1.875 -4]
+	testCase.AddStep(MakeDUP())
+	testCase.AddStep(MakePUSHF(0))
+	testCase.AddStep(MakeFDIV()) // [1.875 -4 -Inf]
+	testCase.AddStep(MakePUSHF(1))
+	testCase.AddStep(MakeFSUB()) // [1.875 -4 -Inf]
+	testCase.AddStackTest(0, math.Float64bits(1.875))
+	testCase.AddStackTest(1, math.Float64bits(-4))
+	testCase.AddStackTest(2, math.Float64bits(math.Inf(-1)))
+	testCase.Assert()
+}
+
+func TestFloatCompare(t *testing.T) {
+	nan := MakePUSHF(math.Float64frombits(0x7ff8000000000000))
+	testCase := MakeTestCase(t)
+	testCase.AddStep(MakePUSHF(-1))
+	testCase.AddStep(MakePUSHF(2))
+	testCase.AddStep(MakeFLT()) // [1]
+	testCase.AddStep(MakePUSHF(2))
+	testCase.AddStep(MakePUSHF(2))
+	testCase.AddStep(MakeFGE()) // [1 1]
+	testCase.AddStep(nan)
+	testCase.AddStep(nan)
+	testCase.AddStep(MakeFEQ()) // [1 1 0]
+	testCase.AddStep(MakePUSHF(3))
+	testCase.AddStep(MakePUSHF(-3))
+	testCase.AddStep(MakeFCMP()) // [1 1 0 1]
+	testCase.AddStep(MakePUSHF(-3))
+	testCase.AddStep(MakePUSHF(3))
+	testCase.AddStep(MakeFCMP()) // [1 1 0 1 -1]
+	testCase.AddStep(nan)
+	testCase.AddStep(MakePUSHF(3))
+	testCase.AddStep(MakeFCMP()) // [1 1 0 1 -1 2]
+	testCase.AddStackTest(0, 1)
+	testCase.AddStackTest(1, 1)
+	testCase.AddStackTest(2, 0)
+	testCase.AddStackTest(3, 1)
+	testCase.AddStackTest(4, 0xffffffffffffffff)
+	testCase.AddStackTest(5, 2)
+	testCase.Assert()
+}
+
+func TestFloatConversion(t *testing.T) {
+	testCase := MakeTestCase(t)
+	testCase.AddStep(MakePUSH(7))
+	testCase.AddStep(MakeNEG())
+	testCase.AddStep(MakeI2F()) // [-7.0]
+	testCase.AddStep(MakePUSH(7))
+	testCase.AddStep(MakeNEG())
+	testCase.AddStep(MakeU2F()) // [-7.0 2^64-7]
+	testCase.AddStep(MakePUSHF(-2.75))
+	testCase.AddStep(MakeF2I()) // [-7.0 2^64-7 -2]
+	testCase.AddStep(MakePUSHF(1e300))
+	testCase.AddStep(MakeF2I()) // [-7.0 2^64-7 -2 MaxInt64]
+	testCase.AddStackTest(0, math.Float64bits(-7))
+	testCase.AddStackTest(1, math.Float64bits(float64(uint64(1<<64-7))))
+	testCase.AddStackTest(2, 0xfffffffffffffffe)
+	testCase.AddStackTest(3, math.MaxInt64)
+	testCase.Assert()
+}
+
+func TestPUSH64(t *testing.T) {
+	var PASSED_LABEL uint64 = 8
+	testCase := MakeTestCase(t)
+	testCase.AddStep(MakePUSH64(0xffffffffffffffff)...)
+	testCase.AddStep(MakePUSH64(0x0123456789abcdef)...)
+	testCase.AddStep(MakePUSH64(PASSED_LABEL)...)
+	testCase.AddStep(MakeJMP())
+	testCase.AddStep(MakePUSH(15)) // Skipped by the jump
+	testCase.AddStep(MakePUSH(2023))
+	testCase.AddStackTest(0, 0xffffffffffffffff)
+	testCase.AddStackTest(1, 0x0123456789abcdef)
+	testCase.AddStackTest(2, 2023)
+	testCase.Assert()
+}
+
+func TestAddInstructionAtomic(t *testing.T) {
+	vm := MakeVM(8 * 10000000)
+	for i := 0; i < int(defaulRomSize/8)-1; i++ {
+		vm.AddInstruction(MakeDUP())
+	}
+	if err := vm.AddInstruction(MakePUSH64(1)...); err != ErrRomFull {
+		t.Errorf("Expected ErrRomFull, got %v", err)
+	}
+	if len(vm.rom) != int(defaulRomSize/8)-1 {
+		t.Errorf("Half of PUSH64 was added")
+	}
+}
+
+func TestOutOfGas(t *testing.T) {
+	testCase := MakeTestCase(t)
+	testCase.vm.SetGasLimit(100)
+	testCase.AddStep(MakePUSH(0)) // 0
+	testCase.AddStep(MakeINC())   // 1
+	testCase.AddStep(MakePUSH(1)) // 2
+	testCase.AddStep(MakeJMP())   // 3 loop forever
+	testCase.AssertFault(OutOfGas, 1)
+	if testCase.vm.GasUsed() != 100 {
+		t.Errorf("Gas used %d, expected 100", testCase.vm.GasUsed())
+	}
+	if testCase.vm.cpu.stack.data[0] != 33 {
+		t.Errorf("Loop ran %d times, expected 33", testCase.vm.cpu.stack.data[0])
+	}
+}
+
+func TestGasTable(t *testing.T) {
+	table := DefaultGasTable()
+	table[PUSH] = 10
+	testCase := MakeTestCase(t)
+	testCase.vm.SetGasTable(table)
+	testCase.vm.SetGasLimit(25)
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakeADD())
+	testCase.AddStep(MakeCALL(5))
+	testCase.AddStep(MakeHLT())
+	err := testCase.vm.StartVM()
+	fault, ok := err.(*Fault)
+	if !ok || fault.Kind != OutOfGas || fault.IP != 3 || fault.Gas != 21 {
+		t.Errorf("Expected out of gas at ip 3 after 21 units, got %v", err)
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	vm := MakeVM(8 * 10000000)
+	vm.AddInstruction(MakePUSH(0)) // 0
+	vm.AddInstruction(MakeINC())   // 1
+	vm.AddInstruction(MakePUSH(1)) // 2
+	vm.AddInstruction(MakeJMP())   // 3 loop forever
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	state, err := vm.RunContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+	if state.Halted || state.IP > 3 || state.Depth < 1 || state.Depth > 2 {
+		t.Errorf("Unexpected state %+v", state)
+	}
+	count := vm.cpu.stack.data[0]
+
+	// A cancelled run can be resumed
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := vm.RunContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+	if vm.cpu.stack.data[0] <= count {
+		t.Errorf("Program did not resume, counter %d then %d", count, vm.cpu.stack.data[0])
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	before := vm.State()
+	state, err = vm.RunContext(ctx)
+	if err != context.Canceled || state != before {
+		t.Errorf("Cancelled context ran the program: %v %+v", err, state)
+	}
+}
+
+func TestWatchpoint(t *testing.T) {
+	makeProgram := func() *TestCase {
+		testCase := MakeTestCase(t)
+		testCase.AddStep(MakePUSH(7))
+		testCase.AddStep(MakePUSH(8))
+		testCase.AddStep(MakeSTORE()) // 2
+		testCase.AddStep(MakePUSH(8))
+		testCase.AddStep(MakeLOAD()) // 4
+		testCase.AddStep(MakePUSH(9))
+		testCase.AddStep(MakePUSH(16))
+		testCase.AddStep(MakeSTORE8()) // 7
+		testCase.AddStep(MakeHLT())
+		return testCase
+	}
+
+	testCase := makeProgram()
+	id := testCase.vm.AddWatchpoint(Watchpoint{Start: 10, End: 11, Kind: WatchWrite})
+	state, err := testCase.vm.RunContext(context.Background())
+	event, ok := err.(*WatchEvent)
+	if !ok {
+		t.Fatalf("Expected a watch event, got %v", err)
+	}
+	expected := WatchEvent{ID: id, Access: WatchWrite, Offset: 8, Size: 8, Old: 0, New: 7, IP: 2}
+	if *event != expected || state.IP != 3 || state.Halted {
+		t.Errorf("Event %+v in state %+v, expected %+v", *event, state, expected)
+	}
+	if _, err := testCase.vm.Continue(context.Background()); err != nil {
+		t.Errorf("Program did not finish after the pause: %v", err)
+	}
+
+	testCase = makeProgram()
+	var events []WatchEvent
+	testCase.vm.AddWatchpoint(Watchpoint{Start: 8, End: 17, Kind: WatchAccess, Callback: func(event WatchEvent) {
+		events = append(events, event)
+	}})
+	removed := testCase.vm.AddWatchpoint(Watchpoint{Start: 0, End: 100, Kind: WatchAccess})
+	testCase.vm.RemoveWatchpoint(removed)
+	testCase.AddStackTest(0, 7)
+	testCase.Assert()
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events, got %+v", events)
+	}
+	if events[1].Access != WatchRead || events[1].IP != 4 || events[1].New != 7 {
+		t.Errorf("Unexpected read event %+v", events[1])
+	}
+	if events[2].Access != WatchWrite || events[2].Size != 1 || events[2].New != 9 {
+		t.Errorf("Unexpected byte write event %+v", events[2])
+	}
+}
+
+func TestTracer(t *testing.T) {
+	var out bytes.Buffer
+	testCase := MakeTestCase(t)
+	testCase.vm.SetTracer(NewTracer(&out))
+	testCase.AddStep(MakePUSH(7))
+	testCase.AddStep(MakePUSH(8))
+	testCase.AddStep(MakeSTORE())
+	testCase.AddStep(MakePUSH64(1 << 60)...)
+	testCase.AddStep(MakeHLT())
+	testCase.Assert()
+	expected := `{"step":0,"ip":0,"op":"PUSH","operand":7,"depth":1,"base":0,"stack":[7]}
+{"step":1,"ip":1,"op":"PUSH","operand":8,"depth":2,"base":0,"stack":[8,7]}
+{"step":2,"ip":2,"op":"STORE","depth":0,"base":0,"stack":[],"mem":[{"access":"write","offset":8,"size":8,"value":7}]}
+{"step":3,"ip":3,"op":"PUSH64","operand":1152921504606846976,"depth":1,"base":0,"stack":[1152921504606846976]}
+{"step":4,"ip":5,"op":"HLT","depth":1,"base":0,"stack":[1152921504606846976]}
+`
+	if out.String() != expected {
+		t.Errorf("Unexpected trace:\n%s", out.String())
+	}
+}
+
+func TestTracerFilters(t *testing.T) {
+	var out bytes.Buffer
+	testCase := MakeTestCase(t)
+	tracer := NewTracer(&out)
+	tracer.From, tracer.To, tracer.Sample, tracer.StackValues = 1, 4, 2, 1
+	testCase.vm.SetTracer(tracer)
+	for i := 0; i < 6; i++ {
+		testCase.AddStep(MakePUSH(uint64(i)))
+	}
+	testCase.AddStep(MakeADD())
+	testCase.AddStep(MakePUSH(0))
+	testCase.AddStep(MakeDIV())
+	testCase.AssertFault(DivisionByZero, 8)
+	expected := `{"step":2,"ip":2,"op":"PUSH","operand":2,"depth":3,"base":0,"stack":[2]}
+`
+	if out.String() != expected {
+		t.Errorf("Unexpected trace:\n%s", out.String())
+	}
+
+	out.Reset()
+	testCase = MakeTestCase(t)
+	testCase.vm.SetTracer(NewTracer(&out))
+	testCase.AddStep(MakePOP())
+	testCase.AssertFault(StackUnderflow, 0)
+	if !strings.Contains(out.String(), `"fault":"stack underflow at ip 0`) {
+		t.Errorf("Fault missing from trace:\n%s", out.String())
+	}
+}
+
+func TestProfiler(t *testing.T) {
+	testCase := MakeTestCase(t)
+	profiler := NewProfiler()
+	testCase.vm.SetProfiler(profiler)
+	testCase.AddStep(MakePUSH(0))
+	testCase.AddStep(MakeCALL(5))
+	testCase.AddStep(MakePUSH(0))
+	testCase.AddStep(MakeCALL(5))
+	testCase.AddStep(MakeHLT())
+	testCase.AddStep(MakePUSH(9))
+	testCase.AddStep(MakeRET())
+	testCase.Assert()
+	if profiler.Executions(5) != 2 || profiler.Executions(4) != 1 || profiler.Executions(7) != 0 {
+		t.Errorf("Unexpected IP counts %d %d %d", profiler.Executions(5), profiler.Executions(4), profiler.Executions(7))
+	}
+	if profiler.OpcodeExecutions(CALL) != 2 || profiler.OpcodeExecutions(PUSH) != 4 {
+		t.Errorf("Unexpected opcode counts %d %d", profiler.OpcodeExecutions(CALL), profiler.OpcodeExecutions(PUSH))
+	}
+	// Each CALL site is a distinct call path into f
+	if n := len(profiler.root.children); n != 2 {
+		t.Errorf("Expected 2 call paths, got %d", n)
+	}
+	var out bytes.Buffer
+	if err := profiler.WritePprof(&out, map[string]uint64{"f": 5}); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := gzip.NewReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	varints, messages := protoFields(t, data)
+	table := make([]string, len(messages[6]))
+	for i, s := range messages[6] {
+		table[i] = string(s)
+	}
+	var types []string
+	for _, msg := range messages[1] {
+		fields, _ := protoFields(t, msg)
+		types = append(types, table[fields[1][0]]+"/"+table[fields[2][0]])
+	}
+	if !reflect.DeepEqual(types, []string{"instructions/count", "cycles/gas"}) || varints[12][0] != 1 {
+		t.Errorf("Unexpected sample types %v", types)
+	}
+	functions := make(map[uint64]string)
+	for _, msg := range messages[5] {
+		fields, _ := protoFields(t, msg)
+		functions[fields[1][0]] = table[fields[2][0]]
+	}
+	type location struct {
+		ip       uint64
+		function string
+	}
+	locations := make(map[uint64]location)
+	for _, msg := range messages[4] {
+		fields, lines := protoFields(t, msg)
+		line, _ := protoFields(t, lines[4][0])
+		name, ok := functions[line[1][0]]
+		if !ok {
+			t.Errorf("Location %d refers to unknown function %d", fields[1][0], line[1][0])
+		}
+		var ip uint64
+		if len(fields[3]) > 0 {
+			ip = fields[3][0]
+		}
+		locations[fields[1][0]] = location{ip: ip, function: name}
+	}
+	if len(functions) != 2 || len(locations) != 7 {
+		t.Errorf("Profile has %d functions and %d locations, expected 2 and 7", len(functions), len(locations))
+	}
+	// Sample values added up by leaf function, and the call sites of f
+	totals := make(map[string][2]uint64)
+	sites := make(map[uint64]uint64)
+	for _, msg := range messages[2] {
+		_, fields := protoFields(t, msg)
+		stack, values := protoVarints(t, fields[1][0]), protoVarints(t, fields[2][0])
+		leaf, ok := locations[stack[0]]
+		if !ok || len(values) != 2 {
+			t.Fatalf("Bad sample %v %v", stack, values)
+		}
+		total := totals[leaf.function]
+		totals[leaf.function] = [2]uint64{total[0] + values[0], total[1] + values[1]}
+		switch leaf.function {
+		case "main":
+			if len(stack) != 1 {
+				t.Errorf("Sample of main at ip %d has %d frames", leaf.ip, len(stack))
+			}
+		case "f":
+			if caller := locations[stack[len(stack)-1]]; len(stack) != 2 || caller.function != "main" {
+				t.Errorf("Sample of f at ip %d is called from %+v", leaf.ip, caller)
+			} else {
+				sites[caller.ip] += values[0]
+			}
+		}
+	}
+	gas := DefaultGasTable()
+	mainGas := 2*gas[PUSH] + 2*gas[CALL] + gas[HLT]
+	fGas := 2 * (gas[PUSH] + gas[RET])
+	if len(messages[2]) != 9 || totals["main"] != [2]uint64{5, mainGas} || totals["f"] != [2]uint64{4, fGas} {
+		t.Errorf("%d samples with totals %v, expected 9 with main %d/%d and f 4/%d", len(messages[2]), totals, 5, mainGas, fGas)
+	}
+	if sites[1] != 2 || sites[3] != 2 {
+		t.Errorf("Unexpected instructions of f by call site %v", sites)
+	}
+}
+
+// protoFields splits a protocol buffer message into its varint fields and its
+// length delimited fields
+func protoFields(t *testing.T, data []byte) (map[int][]uint64, map[int][][]byte) {
+	varints := make(map[int][]uint64)
+	messages := make(map[int][][]byte)
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			t.Fatalf("Bad key in %x", data)
+		}
+		data = data[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			value, n := binary.Uvarint(data)
+			if n <= 0 {
+				t.Fatalf("Bad varint in %x", data)
+			}
+			varints[field] = append(varints[field], value)
+			data = data[n:]
+		case 2:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				t.Fatalf("Bad length in %x", data)
+			}
+			messages[field] = append(messages[field], data[n:n+int(size)])
+			data = data[n+int(size):]
+		default:
+			t.Fatalf("Unexpected wire type %d", key&7)
+		}
+	}
+	return varints, messages
+}
+
+// protoVarints decodes a packed repeated varint field
+func protoVarints(t *testing.T, data []byte) []uint64 {
+	var values []uint64
+	for len(data) > 0 {
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			t.Fatalf("Bad packed varint in %x", data)
+		}
+		values = append(values, value)
+		data = data[n:]
+	}
+	return values
+}
+
+func TestImage(t *testing.T) {
+	image := &Image{
+		Version: ISAVersion,
+		Entry:   2,
+		Code:    []uint64{MakePUSH(1), MakeHLT(), MakePUSH(0), MakeLOAD(), MakeHLT()},
+		Data:    []byte{42, 0, 0, 0, 0, 0, 0, 0},
+		Symbols: map[string]uint64{"main": 2, "other": 0},
+	}
+	var out bytes.Buffer
+	if err := WriteImage(&out, image); err != nil {
+		t.Fatal(err)
+	}
+	file := out.Bytes()
+	loaded, err := LoadImage(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Entry != 2 || len(loaded.Code) != 5 || loaded.Code[3] != MakeLOAD() || !bytes.Equal(loaded.Data, image.Data) || loaded.Symbols["main"] != 2 || len(loaded.Symbols) != 2 {
+		t.Errorf("Image changed after a round trip: %+v", loaded)
+	}
+
+	testCase := MakeTestCase(t)
+	if err := testCase.vm.FlashImage(loaded); err != nil {
+		t.Fatal(err)
+	}
+	testCase.AddStackTest(0, 42)
+	testCase.Assert()
+
+	heap := MakeTestCaseConfig(t, Config{RomSize: 8 * 8, DataSegmentSize: 32, StackDepth: 8, HeapSize: 16})
+	if err := heap.vm.FlashImage(&Image{Version: ISAVersion, Code: image.Code, Data: make([]byte, 17)}); !errors.Is(err, ErrImageInvalid) {
+		t.Errorf("Expected data overlapping the heap to be rejected, got %v", err)
+	}
+	if err := heap.vm.FlashImage(&Image{Version: ISAVersion, Code: image.Code, Data: make([]byte, 16)}); err != nil {
+		t.Errorf("Data below the heap rejected: %v", err)
+	}
+
+	for n := 0; n < len(file); n++ {
+		if _, err := LoadImage(bytes.NewReader(file[:n])); err != ErrImageTruncated {
+			t.Errorf("Image truncated to %d bytes: %v", n, err)
+		}
+	}
+	corrupt := append([]byte(nil), file...)
+	corrupt[40] ^= 1
+	if _, err := LoadImage(bytes.NewReader(corrupt)); err != ErrImageChecksum {
+		t.Errorf("Expected checksum error, got %v", err)
+	}
+	corrupt = append([]byte(nil), file...)
+	corrupt[0] = 'X'
+	if _, err := LoadImage(bytes.NewReader(corrupt)); err != ErrImageMagic {
+		t.Errorf("Expected magic error, got %v", err)
+	}
+	corrupt = append([]byte(nil), file...)
+	corrupt[4] = byte(ISAVersion + 1)
+	if _, err := LoadImage(bytes.NewReader(corrupt)); !errors.Is(err, ErrImageVersion) {
+		t.Errorf("Expected version error, got %v", err)
+	}
+	image.Entry = 5
+	if err := WriteImage(&out, image); !errors.Is(err, ErrImageInvalid) {
+		t.Errorf("Expected invalid entry point, got %v", err)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	config := Config{RomSize: 8 * 8, DataSegmentSize: 32, StackDepth: 8}
+	testCase := MakeTestCaseConfig(t, config)
+	small := testCase.vm
+	if small.Config().MemorySize != 96 || small.getDataSegment() != 64 {
+		t.Errorf("Unexpected layout %+v", small.Config())
+	}
+	testCase.AddStep(MakePUSH(7))
+	testCase.AddStep(MakePUSH(24))
+	testCase.AddStep(MakeSTORE())
+	testCase.AddStep(MakePUSH(24))
+	testCase.AddStep(MakeLOAD())
+	testCase.AddStep(MakeHLT())
+	testCase.AddStackTest(0, 7)
+	testCase.AddMemoryTest(24, 7)
+	testCase.Assert()
+	if err := small.AddInstruction(MakeHLT(), MakeHLT(), MakeHLT()); err != ErrRomFull {
+		t.Errorf("Expected a full ROM, got %v", err)
+	}
+	small.DebugStack() // Holds fewer than 10 values
+
+	testCase = MakeTestCaseConfig(t, config)
+	testCase.AddStep(MakePUSH(32))
+	testCase.AddStep(MakeLOAD())
+	testCase.AssertFault(MemoryOutOfBounds, 1)
+
+	// The stack holds exactly StackDepth values
+	exact := config
+	exact.StackDepth = 7
+	testCase = MakeTestCaseConfig(t, exact)
+	for i := 0; i < 7; i++ {
+		testCase.AddStep(MakePUSH(uint64(i)))
+	}
+	testCase.AddStep(MakeHLT())
+	testCase.AddStackTest(6, 6)
+	testCase.Assert()
+
+	testCase = MakeTestCaseConfig(t, exact)
+	for i := 0; i < 8; i++ {
+		testCase.AddStep(MakePUSH(1))
+	}
+	testCase.AssertFault(StackOverflow, 7)
+
+	exact.StackDepth = 1
+	testCase = MakeTestCaseConfig(t, exact)
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakePUSH(2))
+	testCase.AssertFault(StackOverflow, 1)
+
+	invalid := []struct {
+		config Config
+		msg    string
+	}{
+		{Config{RomSize: 12, StackDepth: 8}, "ROM size 12"},
+		{Config{RomSize: 8, CodeSegmentSize: 4, StackDepth: 8}, "code segment size 4"},
+		{Config{RomSize: 8}, "stack depth is 0"},
+		{Config{RomSize: 8, StackDepth: 1<<32 - 1}, "stack depth 4294967295 exceeds"},
+		{Config{RomSize: 8, StackDepth: 1<<32 - 1, GrowableStack: true}, "stack depth 4294967295 exceeds"},
+		{Config{RomSize: 8, DataSegmentSize: 8, HeapSize: 16, StackDepth: 8}, "heap size 16"},
+		{Config{MemorySize: 15, RomSize: 8, DataSegmentSize: 8, StackDepth: 8}, "memory size 15 is too small"},
+		{Config{RomSize: 1 << 31, DataSegmentSize: 1 << 31, StackDepth: 8}, "exceed 4GB"},
+	}
+	for _, c := range invalid {
+		_, err := NewVM(c.config)
+		if !errors.Is(err, ErrInvalidConfig) || !strings.Contains(err.Error(), c.msg) {
+			t.Errorf("%+v: expected %q, got %v", c.config, c.msg, err)
+		}
+	}
+	if MakeVM(1000) != nil {
+		t.Errorf("MakeVM accepts a memory too small for the default layout")
+	}
+}
+
+func TestGrowableStack(t *testing.T) {
+	config := DefaultConfig()
+	config.StackDepth, config.GrowableStack = 1<<20, true
+	testCase := MakeTestCaseConfig(t, config)
+	stack := testCase.vm.cpu.stack
+	if len(stack.data) != initialGrowableSize {
+		t.Fatalf("Growable stack starts with %d values", len(stack.data))
+	}
+	testCase.AddStep(MakePUSH(1))
+	testCase.AddStep(MakePUSH(0))
+	testCase.AddStep(MakeJMP())
+	testCase.AssertFault(StackOverflow, 1)
+	if stack.index != 1<<20 || len(stack.data) != 1<<20 {
+		t.Errorf("Stack overflows at %d values with %d allocated", stack.index, len(stack.data))
+	}
+}
+
+func TestCallDepth(t *testing.T) {
+	config := DefaultConfig()
+	config.CallDepth = 100
+	testCase := MakeTestCaseConfig(t, config)
+	testCase.AddStep(MakePUSH(0))
+	testCase.AddStep(MakeCALL(0))
+	testCase.AssertFault(CallDepthExceeded, 1)
+	if calls := testCase.vm.State().Calls; calls != 100 {
+		t.Errorf("Call depth exceeded with %d frames", calls)
+	}
+
+	testCase = MakeTestCase(t)
+	testCase.AddStep(MakePUSH(0))
+	testCase.AddStep(MakeCALL(4))
+	testCase.AddStep(MakeHLT())
+	testCase.AddStep(MakeHLT())
+	testCase.AddStep(MakeRET())
+	testCase.Assert()
+	if calls := testCase.vm.State().Calls; calls != 0 {
+		t.Errorf("%d frames after RET", calls)
+	}
+}
+
+func TestMemoryProtection(t *testing.T) {
+	data := uint64(defaulRomSize + codeSegmentSize)
+	faults := []struct {
+		code []uint64
+		kind FaultKind
+		addr uint64
+	}{
+		// Wrap around to the start of the ROM
+		{append(MakePUSH64(-data), MakeSTORE8()), MemoryProtection, 0},
+		{append(MakePUSH64(math.MaxUint64-7), MakeSTORE()), MemoryProtection, data - 8},
+		// Straddle the end of the data segment
+		{[]uint64{MakePUSH(uint64(dataSegmentSize) - 4), MakeSTORE()}, MemoryProtection, data + uint64(dataSegmentSize) - 4},
+		{[]uint64{MakePUSH(1 << 40), MakeLOAD8()}, MemoryOutOfBounds, data + 1<<40},
+		// Execute the data segment
+		{[]uint64{MakePUSH(data / 8), MakeJMP()}, MemoryProtection, data},
+	}
+	for _, f := range faults {
+		testCase := MakeTestCase(t)
+		testCase.AddStep(MakePUSH(0xab))
+		testCase.AddStep(f.code...)
+		err := testCase.vm.StartVM()
+		fault, ok := err.(*Fault)
+		if !ok || fault.Kind != f.kind || fault.Addr != f.addr {
+			t.Errorf("Expected %s at address %d, got %v", f.kind, f.addr, err)
+		}
+		if testCase.vm.LoadInstruction(0) != MakePUSH(0xab) {
+			t.Errorf("ROM was overwritten")
+		}
+	}
+
+	// The code segment is readable
+	testCase := MakeTestCase(t)
+	testCase.AddStep(MakePUSH64(math.MaxUint64 - 7)...)
+	testCase.AddStep(MakeLOAD())
+	testCase.AddStackTest(0, 0)
+	testCase.Assert()
+
+	testCase = MakeTestCase(t)
+	if err := testCase.vm.Protect("rom", PermRead); err != nil {
+		t.Fatal(err)
+	}
+	testCase.AddStep(MakeHLT())
+	testCase.AssertFault(MemoryProtection, 0)
+	if err := testCase.vm.Protect("heap", PermRead); err == nil {
+		t.Errorf("Protect accepts an unknown segment")
+	}
+	segments := testCase.vm.Segments()
+	if len(segments) != 3 || segments[0].Perm.String() != "r--" || segments[2].Perm.String() != "rw-" || segments[2].End != data+uint64(dataSegmentSize) {
+		t.Errorf("Unexpected segments %+v", segments)
+	}
+}
+
+func TestSyscall(t *testing.T) {
+	var out bytes.Buffer
+	testCase := MakeTestCase(t)
+	testCase.vm.SetStdio(strings.NewReader("xyz"), &out)
+	testCase.vm.RegisterSyscall(100, func(cpu *CPU) error {
+		a, err := cpu.Pop()
+		if err != nil {
+			return err
+		}
+		return cpu.Push(a * 2)
+	})
+	testCase.AddStep(MakePUSH('h'))
+	testCase.AddStep(MakeSYSCALL(SysWriteByte))
+	testCase.AddStep(MakePUSH64(math.MaxUint64 - 4)...)
+	testCase.AddStep(MakeSYSCALL(SysWriteInt))
+	testCase.AddStep(MakePUSH64(math.MaxUint64)...)
+	testCase.AddStep(MakeSYSCALL(SysWriteUint))
+	testCase.AddStep(MakeSYSCALL(SysReadByte))
+	testCase.AddStep(MakePUSH(16))
+	testCase.AddStep(MakePUSH(8))
+	testCase.AddStep(MakeSYSCALL(SysRead))
+	testCase.AddStep(MakePUSH(16))
+	testCase.AddStep(MakePUSH(2))
+	testCase.AddStep(MakeSYSCALL(SysWrite))
+	testCase.AddStep(MakeSYSCALL(SysReadByte))
+	testCase.AddStep(MakePUSH(21))
+	testCase.AddStep(MakeSYSCALL(100))
+	var events []WatchEvent
+	testCase.vm.AddWatchpoint(Watchpoint{Start: 16, End: 17, Kind: WatchAccess, Callback: func(event WatchEvent) {
+		events = append(events, event)
+	}})
+	testCase.AddStackTest(0, 'x')
+	testCase.AddStackTest(1, 2)
+	testCase.AddStackTest(2, math.MaxUint64)
+	testCase.AddStackTest(3, 42)
+	testCase.AddMemoryTest(16, 'y')
+	testCase.AddMemoryTest(17, 'z')
+	testCase.Assert()
+	if out.String() != "h-518446744073709551615yz" {
+		t.Errorf("Unexpected output %q", out.String())
+	}
+	if len(events) != 2 || events[0].Access != WatchWrite || events[0].Size != 2 || events[0].New != 'y'|'z'<<8 || events[1].Access != WatchRead {
+		t.Errorf("Unexpected buffer events %+v", events)
+	}
+
+	testCase = MakeTestCase(t)
+	testCase.AddStep(MakeSYSCALL(99))
+	testCase.AssertFault(UnknownSyscall, 0)
+
+	testCase = MakeTestCase(t)
+	testCase.vm.SetStdio(strings.NewReader(""), &out)
+	testCase.AddStep(MakePUSH64(math.MaxUint64)...)
+	testCase.AddStep(MakePUSH(8))
+	testCase.AddStep(MakeSYSCALL(SysWrite))
+	testCase.AssertFault(MemoryProtection, 3)
+}
+
+func TestHeap(t *testing.T) {
+	config := DefaultConfig()
+	config.HeapSize = 64
+	heapStart := uint64(dataSegmentSize - 64)
+	testCase := MakeTestCaseConfig(t, config)
+	testCase.AddStep(MakePUSH(10))
+	testCase.AddStep(MakeALLOC()) // a at heapStart, 16 bytes
+	testCase.AddStep(MakePUSH(8))
+	testCase.AddStep(MakeALLOC()) // b at heapStart+16
+	testCase.AddStep(MakePUSH(0x1234))
+	testCase.AddStep(MakePUSH(heapStart))
+	testCase.AddStep(MakeSTORE())
+	testCase.AddStep(MakePUSH(heapStart))
+	testCase.AddStep(MakePUSH(24))
+	testCase.AddStep(MakeREALLOC()) // a moves to heapStart+24
+	testCase.AddStep(MakeDUP())
+	testCase.AddStep(MakeLOAD())
+	testCase.AddStep(MakePUSH(100))
+	testCase.AddStep(MakeALLOC()) // does not fit
+	testCase.AddStep(MakePUSH(heapStart + 16))
+	testCase.AddStep(MakeFREE())
+	testCase.AddStep(MakePUSH(24))
+	testCase.AddStep(MakeALLOC()) // reuses the merged hole at heapStart
+	testCase.AddStackTest(0, heapStart)
+	testCase.AddStackTest(1, heapStart+16)
+	testCase.AddStackTest(2, heapStart+24)
+	testCase.AddStackTest(3, 0x1234)
+	testCase.AddStackTest(4, 0)
+	testCase.AddStackTest(5, heapStart)
+	testCase.Assert()
+	stats := testCase.vm.HeapStats()
+	expected := HeapStats{Size: 64, InUse: 48, Peak: 48, LiveBlocks: 2, Allocs: 4, Frees: 2, Failures: 1, LargestFree: 16}
+	if stats != expected {
+		t.Errorf("Heap stats %+v, expected %+v", stats, expected)
+	}
+
+	testCase = MakeTestCaseConfig(t, config)
+	testCase.AddStep(MakePUSH(heapStart + 8))
+	testCase.AddStep(MakeFREE())
+	testCase.AssertFault(InvalidFree, 1)
+
+	config.HeapDebug = true
+	testCase = MakeTestCaseConfig(t, config)
+	testCase.AddStep(MakePUSH(8))
+	testCase.AddStep(MakeALLOC())
+	testCase.AddStep(MakeDUP())
+	testCase.AddStep(MakeDUP())
+	testCase.AddStep(MakeFREE())
+	testCase.AddStep(MakeFREE())
+	testCase.AssertFault(DoubleFree, 5)
+
+	testCase = MakeTestCaseConfig(t, config)
+	testCase.AddStep(MakePUSH(8))
+	testCase.AddStep(MakeALLOC())
+	testCase.AddStep(MakeDUP())
+	testCase.AddStep(MakeFREE())
+	testCase.AddStep(MakePUSH(8))
+	testCase.AddStep(MakeALLOC()) // freed blocks are not reused
+	testCase.AddStep(MakePOP())
+	testCase.AddStep(MakeLOAD8())
+	testCase.AssertFault(UseAfterFree, 7)
+
+	// Syscall buffers are checked like LOAD and STORE
+	testCase = MakeTestCaseConfig(t, config)
+	testCase.vm.SetStdio(strings.NewReader(""), io.Discard)
+	testCase.AddStep(MakePUSH(8))
+	testCase.AddStep(MakeALLOC())
+	testCase.AddStep(MakeDUP())
+	testCase.AddStep(MakeFREE())
+	testCase.AddStep(MakePUSH(8))
+	testCase.AddStep(MakeSYSCALL(SysWrite))
+	testCase.AssertFault(UseAfterFree, 5)
+
+	testCase = MakeTestCaseConfig(t, config)
+	testCase.vm.SetStdio(strings.NewReader(""), io.Discard)
+	for i := 0; i < 3; i++ {
+		testCase.AddStep(MakePUSH(8))
+		testCase.AddStep(MakeALLOC())
+	}
+	testCase.AddStep(MakePOP())
+	testCase.AddStep(MakeFREE())
+	testCase.AddStep(MakePUSH(24)) // Spans the freed block between two live ones
+	testCase.AddStep(MakeSYSCALL(SysWrite))
+	testCase.AssertFault(UseAfterFree, 9)
+}
+
+func TestSnapshot(t *testing.T) {
+	config := DefaultConfig()
+	config.HeapSize = 1024
+	original, err := NewVM(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original.FlashRom([]uint64{
+		MakePUSH(16), MakeALLOC(), // 0
+		MakePUSH(0), MakeCALL(10), // 2
+		MakePUSH(0), MakeCALL(10), // 4
+		MakeADD(), MakeADD(), MakeHLT(), MakeHLT(), // 6
+		MakePUSH(100), MakeLOAD(), MakeINC(), MakeDUP(), MakePUSH(100), MakeSTORE(), MakeRET(), // 10
+	})
+	original.SetGasLimit(1000)
+	original.LoadRom()
+	for i := 0; i < 8; i++ {
+		if err := original.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var out bytes.Buffer
+	if err := original.Snapshot(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() > 4096 {
+		t.Errorf("Snapshot of a mostly empty memory takes %d bytes", out.Len())
+	}
+	restored, err := Restore(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.State() != original.State() || restored.HeapStats() != original.HeapStats() {
+		t.Errorf("Restored state %+v, expected %+v", restored.State(), original.State())
+	}
+	for _, machine := range []*VM{original, restored} {
+		if _, err := machine.Continue(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if restored.State() != original.State() || !bytes.Equal(restored.memory, original.memory) {
+		t.Errorf("Restored VM ends in %+v, expected %+v", restored.State(), original.State())
+	}
+	if stack := restored.Stack(); len(stack) != 1 || stack[0] != uint64(dataSegmentSize-1024)+3 {
+		t.Errorf("Unexpected stack %v", stack)
+	}
+	if a, b := original.cpu.Rand().Uint64(), restored.cpu.Rand().Uint64(); a != b {
+		t.Errorf("Restored VM draws %x, expected %x", b, a)
+	}
+
+	if _, err := Restore(strings.NewReader("SVMS\x01\x00garbage")); !errors.Is(err, ErrSnapshotInvalid) {
+		t.Errorf("Expected invalid snapshot, got %v", err)
+	}
+
+	// Heap blocks of a crafted snapshot must stay inside the heap
+	start, end := original.heap.start, original.heap.end
+	for _, live := range [][]block{
+		{{start: end, size: 16}},
+		{{start: start, size: math.MaxUint64 - 7}},
+		{{start: start - 8, size: 8}},
+		{{start: start, size: 0}},
+		{{start: start + 16, size: 8}, {start: start, size: 8}},
+		{{start: start, size: 32}},
+	} {
+		machine, _ := NewVM(config)
+		machine.heap.free = []block{{start: start + 24, size: end - start - 24}}
+		machine.heap.live = live
+		out.Reset()
+		if err := machine.Snapshot(&out); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Restore(&out); !errors.Is(err, ErrSnapshotInvalid) {
+			t.Errorf("Heap blocks %v: expected invalid snapshot, got %v", live, err)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	unknown := uint64(0xff) << 56
+	tests := []struct {
+		name    string
+		rom     []uint64
+		indices []uint64
+	}{
+		{"valid", []uint64{MakePUSH(2), MakePUSH(3), MakeADD(), MakeHLT()}, nil},
+		{"unknown opcode", []uint64{MakePUSH(1), unknown, MakeHLT()}, []uint64{1}},
+		{"immediate is not an opcode", append(MakePUSH64(unknown), MakePOP(), MakeHLT()), nil},
+		{"call out of range", []uint64{MakePUSH(0), MakeCALL(99), MakeHLT()}, []uint64{1}},
+		{"falls off the end", []uint64{MakePUSH(1), MakePOP()}, []uint64{1}},
+		{"underflow", []uint64{MakePUSH(1), MakeADD(), MakeHLT()}, []uint64{1}},
+		{"loop grows the stack", []uint64{MakePUSH(1), MakePUSH(0), MakeJMP()}, []uint64{0}},
+		{"branches differ", []uint64{MakePUSH(0), MakePUSH(4), MakeJZ(), MakePUSH(9), MakeHLT()}, []uint64{4}},
+		{"jump into immediate", append([]uint64{MakePUSH(3), MakeJMP()}, append(MakePUSH64(1), MakeHLT())...), []uint64{1}},
+		{"function result", []uint64{
+			MakePUSH(5), MakePUSH(1), MakeCALL(5), MakePOP(), MakeHLT(),
+			MakePUSH(0), MakeSLOAD(), MakeINC(), MakeRET(),
+		}, nil},
+		{"result popped twice", []uint64{
+			MakePUSH(5), MakePUSH(1), MakeCALL(6), MakePOP(), MakePOP(), MakeHLT(),
+			MakePUSH(0), MakeSLOAD(), MakeRET(),
+		}, []uint64{4}},
+		{"missing parameters", []uint64{MakePUSH(2), MakeCALL(3), MakeHLT(), MakeRET()}, []uint64{1}},
+		{"syscalls", []uint64{MakeSYSCALL(SysReadByte), MakeSYSCALL(SysWriteByte), MakeHLT()}, nil},
+		{"syscall underflow", []uint64{MakeSYSCALL(SysWriteByte), MakeHLT()}, []uint64{0}},
+		{"ret outside function", []uint64{MakePUSH(0), MakeRET()}, []uint64{1}},
+	}
+	for _, test := range tests {
+		diagnostics := Verify(test.rom, 0)
+		indices := []uint64(nil)
+		for _, diagnostic := range diagnostics {
+			indices = append(indices, diagnostic.Index)
+		}
+		if !reflect.DeepEqual(indices, test.indices) {
+			t.Errorf("%s: diagnostics %v, expected at %v", test.name, diagnostics, test.indices)
+		}
+	}
+
+	config := DefaultConfig()
+	config.Verify = true
+	testCase := MakeTestCaseConfig(t, config)
+	testCase.AddStep(MakePUSH(1), MakeADD(), MakeHLT())
+	state, err := testCase.vm.RunContext(context.Background())
+	var verifyErr *VerifyError
+	if !errors.As(err, &verifyErr) || len(verifyErr.Diagnostics) != 1 || state.Steps != 0 {
+		t.Errorf("Expected the ROM to be rejected before running, got %v after %d steps", err, state.Steps)
+	}
+	testCase = MakeTestCaseConfig(t, config)
+	testCase.AddStep(MakePUSH(1), MakePUSH(2), MakeADD(), MakeHLT())
+	testCase.AddStackTest(0, 3)
+	testCase.Assert()
+
+	// A resumed program is not verified again from where it stopped
+	machine, _ := NewVM(config)
+	machine.FlashRom([]uint64{MakePUSH(0), MakeINC(), MakePUSH(1), MakeJMP()})
+	machine.LoadRom()
+	for i := 0; i < 3; i++ {
+		if err := machine.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if state, err := machine.RunContext(ctx); err != context.Canceled || state.IP != 3 {
+		t.Errorf("Cancelled run stopped at ip %d with %v", state.IP, err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if state, err := machine.RunContext(ctx); err != context.DeadlineExceeded || state.Steps <= 3 {
+		t.Errorf("Resumed run stopped after %d steps with %v", state.Steps, err)
+	}
+	if state, err := machine.Continue(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Continue stopped after %d steps with %v", state.Steps, err)
+	}
+}
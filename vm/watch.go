@@ -0,0 +1,88 @@
+package vm
+
+import "fmt"
+
+type WatchKind uint8
+
+const (
+	WatchRead WatchKind = 1 << iota
+	WatchWrite
+	WatchAccess = WatchRead | WatchWrite
+)
+
+func (kind WatchKind) String() string {
+	switch kind {
+	case WatchRead:
+		return "read"
+	case WatchWrite:
+		return "write"
+	case WatchAccess:
+		return "access"
+	}
+	return fmt.Sprintf("watch %d", uint8(kind))
+}
+
+// Watchpoint observes LOAD and STORE instructions and syscall buffers touching
+// the data segment bytes from Start up to but not including End. Old and New
+// hold the first 8 bytes of longer buffers.
+type Watchpoint struct {
+	Start    uint64
+	End      uint64
+	Kind     WatchKind
+	Callback func(WatchEvent) // When nil the program pauses instead
+}
+
+// WatchEvent describes an access hitting a watchpoint. It is returned as an
+// error by Run when the program pauses, VM.Continue resumes it.
+type WatchEvent struct {
+	ID     int // As returned by AddWatchpoint
+	Access WatchKind
+	Offset uint64 // Data segment offset of the access
+	Size   uint64
+	Old    uint64 // Value before the access
+	New    uint64 // Value after the access, equal to Old for reads
+	IP     uint64
+}
+
+func (event *WatchEvent) Error() string {
+	return fmt.Sprintf("watchpoint %d: %s of %d bytes at %d by ip %d, %d -> %d",
+		event.ID, event.Access, event.Size, event.Offset, event.IP, event.Old, event.New)
+}
+
+type watchEntry struct {
+	id int
+	Watchpoint
+}
+
+// AddWatchpoint returns an id for RemoveWatchpoint
+func (vm *VM) AddWatchpoint(watchpoint Watchpoint) int {
+	vm.nextWatchID++
+	vm.watchpoints = append(vm.watchpoints, watchEntry{id: vm.nextWatchID, Watchpoint: watchpoint})
+	return vm.nextWatchID
+}
+
+// RemoveWatchpoint deletes the watchpoint with id, unknown ids are ignored
+func (vm *VM) RemoveWatchpoint(id int) {
+	for i, entry := range vm.watchpoints {
+		if entry.id == id {
+			vm.watchpoints = append(vm.watchpoints[:i], vm.watchpoints[i+1:]...)
+			return
+		}
+	}
+}
+
+// watch reports an access to the watchpoints it overlaps, the first one
+// without a callback pauses the CPU once the instruction completes
+func (cpu *CPU) watch(access WatchKind, offset uint64, size uint64, old uint64, new uint64) {
+	for _, entry := range cpu.vm.watchpoints {
+		if entry.Kind&access == 0 || offset >= entry.End || offset+size <= entry.Start {
+			continue
+		}
+		event := WatchEvent{ID: entry.id, Access: access, Offset: offset, Size: size, Old: old, New: new, IP: cpu.at}
+		if entry.Callback != nil {
+			entry.Callback(event)
+		} else if cpu.paused == nil {
+			cpu.paused = &event
+		}
+	}
+}